@@ -2,23 +2,41 @@ package log_v1
 
 import (
 	"fmt"
+	"strconv"
+	"time"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
+// errorDomain is the domain of the ErrorInfo details the Log service sends.
+const errorDomain = "proglog"
+
+// electionRetryDelay is how long a client is told to wait before retrying
+// while the cluster has no leader.
+const electionRetryDelay = time.Second
+
 type ErrOffsetOutOfRange struct {
 	Offset uint64
+	// Removed is set if the offset is below the lowest one in the log,
+	// rather than not written yet.
+	Removed bool
 }
 
 func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
-	st := status.New(404, fmt.Sprintf("offset of range: %d", e.Offset))
+	st := status.New(codes.OutOfRange, fmt.Sprintf("offset of range: %d", e.Offset))
 	msg := fmt.Sprintf("The request offset is outside the log's range: %d", e.Offset)
 	d := &errdetails.LocalizedMessage{
 		Locale:  "en-US",
 		Message: msg,
 	}
-	std, err := st.WithDetails(d)
+	desc := "not written yet"
+	if e.Removed {
+		desc = "removed by retention"
+	}
+	std, err := st.WithDetails(d, offsetResource(e.Offset, desc))
 	if err != nil {
 		return st
 	}
@@ -28,3 +46,512 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+type ErrCorruptRecord struct {
+	Path string
+	Pos  uint64
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	st := status.New(codes.DataLoss, fmt.Sprintf("corrupt record: %s at %d", e.Path, e.Pos))
+	msg := fmt.Sprintf("The record stored in %s at position %d is corrupt", e.Path, e.Pos)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	info := &errdetails.ErrorInfo{
+		Reason: "CORRUPT_RECORD",
+		Domain: errorDomain,
+		Metadata: map[string]string{
+			"path": e.Path,
+			"pos":  strconv.FormatUint(e.Pos, 10),
+		},
+	}
+	std, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrOffsetCompacted struct {
+	Offset uint64
+}
+
+func (e ErrOffsetCompacted) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, fmt.Sprintf("offset compacted: %d", e.Offset))
+	msg := fmt.Sprintf("The record at offset %d was removed by compaction", e.Offset)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d, offsetResource(e.Offset, "removed by compaction"))
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOffsetCompacted) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// notLeaderReason is the ErrorInfo reason of ErrNotLeader.
+const notLeaderReason = "NOT_LEADER"
+
+// ErrNotLeader is returned by a follower for a request only the leader can
+// serve. LeaderID and LeaderAddr point at the current leader and are empty
+// while there is none.
+type ErrNotLeader struct {
+	LeaderID   string
+	LeaderAddr string
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, fmt.Sprintf("not the leader: leader is %q at %q", e.LeaderID, e.LeaderAddr))
+	msg := "The request must be sent to the leader"
+	if e.LeaderAddr != "" {
+		msg = fmt.Sprintf("The request must be sent to the leader at %s", e.LeaderAddr)
+	}
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	info := &errdetails.ErrorInfo{
+		Reason: notLeaderReason,
+		Domain: errorDomain,
+		Metadata: map[string]string{
+			"leader_id":   e.LeaderID,
+			"leader_addr": e.LeaderAddr,
+		},
+	}
+	// With a known leader the client can retry there right away.
+	var delay time.Duration
+	if e.LeaderAddr == "" {
+		delay = electionRetryDelay
+	}
+	retry := &errdetails.RetryInfo{RetryDelay: durationpb.New(delay)}
+	std, err := st.WithDetails(d, info, retry)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// NotLeader extracts the leader hint from an error a client got back,
+// reporting whether it was an ErrNotLeader.
+func NotLeader(err error) (ErrNotLeader, bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return ErrNotLeader{}, false
+	}
+	for _, d := range st.Details() {
+		info, ok := d.(*errdetails.ErrorInfo)
+		if ok && info.Reason == notLeaderReason {
+			return ErrNotLeader{
+				LeaderID:   info.Metadata["leader_id"],
+				LeaderAddr: info.Metadata["leader_addr"],
+			}, true
+		}
+	}
+	return ErrNotLeader{}, false
+}
+
+// ErrLeadershipChanged is returned when a write couldn't be committed
+// because the leader changed while it was in flight. Retrying it is safe
+// once a new leader has been elected.
+type ErrLeadershipChanged struct {
+	Cause string
+}
+
+func (e ErrLeadershipChanged) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, fmt.Sprintf("leadership changed: %s", e.Cause))
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: "The leader changed while the request was in flight; retry it",
+	}
+	info := &errdetails.ErrorInfo{
+		Reason: "LEADERSHIP_CHANGED",
+		Domain: errorDomain,
+		Metadata: map[string]string{
+			"cause": e.Cause,
+		},
+	}
+	retry := &errdetails.RetryInfo{RetryDelay: durationpb.New(electionRetryDelay)}
+	std, err := st.WithDetails(d, info, retry)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrLeadershipChanged) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrRecordTooLarge is returned for a record bigger than a segment can
+// store.
+type ErrRecordTooLarge struct {
+	Size uint64
+	Max  uint64
+}
+
+func (e ErrRecordTooLarge) GRPCStatus() *status.Status {
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf("record too large: %d bytes", e.Size))
+	msg := fmt.Sprintf("The record is %d bytes, over the limit of %d bytes", e.Size, e.Max)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	info := &errdetails.ErrorInfo{
+		Reason: "RECORD_TOO_LARGE",
+		Domain: errorDomain,
+		Metadata: map[string]string{
+			"size": strconv.FormatUint(e.Size, 10),
+			"max":  strconv.FormatUint(e.Max, 10),
+		},
+	}
+	quota := &errdetails.QuotaFailure{
+		Violations: []*errdetails.QuotaFailure_Violation{{
+			Subject:     "record",
+			Description: msg,
+		}},
+	}
+	std, err := st.WithDetails(d, info, quota)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrRecordTooLarge) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func offsetResource(off uint64, desc string) *errdetails.ResourceInfo {
+	return &errdetails.ResourceInfo{
+		ResourceType: "offset",
+		ResourceName: strconv.FormatUint(off, 10),
+		Description:  desc,
+	}
+}
+
+// ErrNoCommittedOffset is returned when fetching the offset of a consumer
+// group that hasn't committed one.
+type ErrNoCommittedOffset struct {
+	Group string
+}
+
+func (e ErrNoCommittedOffset) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, fmt.Sprintf("no committed offset: %s", e.Group))
+	msg := fmt.Sprintf("The consumer group %s hasn't committed an offset", e.Group)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	resource := &errdetails.ResourceInfo{
+		ResourceType: "consumer_group",
+		ResourceName: e.Group,
+		Description:  "no committed offset",
+	}
+	std, err := st.WithDetails(d, resource)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNoCommittedOffset) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnknownProducer is returned for a record sent with a producer ID that
+// wasn't registered.
+type ErrUnknownProducer struct {
+	ProducerID uint64
+}
+
+func (e ErrUnknownProducer) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf("unknown producer: %d", e.ProducerID))
+	msg := fmt.Sprintf("The producer %d must be registered before producing", e.ProducerID)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	info := &errdetails.ErrorInfo{
+		Reason: "UNKNOWN_PRODUCER",
+		Domain: errorDomain,
+		Metadata: map[string]string{
+			"producer_id": strconv.FormatUint(e.ProducerID, 10),
+		},
+	}
+	std, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrUnknownProducer) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrStaleSequence is returned for a record whose sequence number is too
+// old to tell whether it was appended.
+type ErrStaleSequence struct {
+	ProducerID uint64
+	Sequence   uint64
+	Last       uint64
+}
+
+func (e ErrStaleSequence) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf("stale sequence: %d", e.Sequence))
+	msg := fmt.Sprintf("The producer %d already sent sequence %d; %d is too old to resend", e.ProducerID, e.Last, e.Sequence)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	info := &errdetails.ErrorInfo{
+		Reason: "STALE_SEQUENCE",
+		Domain: errorDomain,
+		Metadata: map[string]string{
+			"producer_id": strconv.FormatUint(e.ProducerID, 10),
+			"sequence":    strconv.FormatUint(e.Sequence, 10),
+			"last":        strconv.FormatUint(e.Last, 10),
+		},
+	}
+	std, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrStaleSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrSequenceGap is returned for a record whose sequence number skips ahead
+// of the next one the producer should send.
+type ErrSequenceGap struct {
+	ProducerID uint64
+	Sequence   uint64
+	Last       uint64
+}
+
+func (e ErrSequenceGap) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf("sequence gap: %d", e.Sequence))
+	msg := fmt.Sprintf("The producer %d last sent sequence %d; %d must follow it", e.ProducerID, e.Last, e.Last+1)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	info := &errdetails.ErrorInfo{
+		Reason: "SEQUENCE_GAP",
+		Domain: errorDomain,
+		Metadata: map[string]string{
+			"producer_id": strconv.FormatUint(e.ProducerID, 10),
+			"sequence":    strconv.FormatUint(e.Sequence, 10),
+			"last":        strconv.FormatUint(e.Last, 10),
+		},
+	}
+	std, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrSequenceGap) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrConditionFailed is returned for a conditional append whose expected
+// offset no longer matches. Actual is the offset it found, -1 if there was
+// none. Key is set when the condition was on the latest record of a key.
+type ErrConditionFailed struct {
+	Key      []byte
+	Expected int64
+	Actual   int64
+}
+
+func (e ErrConditionFailed) GRPCStatus() *status.Status {
+	what := "last offset"
+	if e.Key != nil {
+		what = fmt.Sprintf("offset of key %q", e.Key)
+	}
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf("condition failed: %s is %d", what, e.Actual))
+	msg := fmt.Sprintf("The %s is %d, not the expected %d", what, e.Actual, e.Expected)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	info := &errdetails.ErrorInfo{
+		Reason: "CONDITION_FAILED",
+		Domain: errorDomain,
+		Metadata: map[string]string{
+			"expected": strconv.FormatInt(e.Expected, 10),
+			"actual":   strconv.FormatInt(e.Actual, 10),
+		},
+	}
+	if e.Key != nil {
+		info.Metadata["key"] = string(e.Key)
+	}
+	std, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrConditionFailed) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTopicNotFound is returned for a topic that doesn't exist.
+type ErrTopicNotFound struct {
+	Topic string
+}
+
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, fmt.Sprintf("topic not found: %s", e.Topic))
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: fmt.Sprintf("The topic %s doesn't exist", e.Topic),
+	}
+	std, err := st.WithDetails(d, topicResource(e.Topic, "not found"))
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTopicExists is returned when creating a topic that already exists.
+type ErrTopicExists struct {
+	Topic string
+}
+
+func (e ErrTopicExists) GRPCStatus() *status.Status {
+	st := status.New(codes.AlreadyExists, fmt.Sprintf("topic exists: %s", e.Topic))
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: fmt.Sprintf("The topic %s already exists", e.Topic),
+	}
+	std, err := st.WithDetails(d, topicResource(e.Topic, "already exists"))
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrTopicExists) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrInvalidTopicName is returned for a topic name that can't be used as
+// a directory name.
+type ErrInvalidTopicName struct {
+	Topic string
+}
+
+func (e ErrInvalidTopicName) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("invalid topic name: %q", e.Topic))
+	d := &errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+			Field:       "topic",
+			Description: "Topic names consist of letters, digits, '.', '_' and '-'",
+		}},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrInvalidTopicName) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrPartitionNotFound is returned for a partition past the partitions of
+// a topic. The default log, with an empty Topic, has only partition 0.
+type ErrPartitionNotFound struct {
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrPartitionNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("partition not found: %s/%d", e.Topic, e.Partition),
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale: "en-US",
+		Message: fmt.Sprintf(
+			"The partition %d of the topic %q doesn't exist",
+			e.Partition,
+			e.Topic,
+		),
+	}
+	std, err := st.WithDetails(d, &errdetails.ResourceInfo{
+		ResourceType: "partition",
+		ResourceName: fmt.Sprintf("%s/%d", e.Topic, e.Partition),
+		Description:  "not found",
+	})
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrPartitionNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrPartitionRequired is returned for a record produced to a topic that
+// requires producers to choose the partition themselves.
+type ErrPartitionRequired struct {
+	Topic string
+}
+
+func (e ErrPartitionRequired) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("partition required: %s", e.Topic),
+	)
+	d := &errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+			Field:       "partition",
+			Description: "Records of this topic must name their partition",
+		}},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrPartitionRequired) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func topicResource(topic, desc string) *errdetails.ResourceInfo {
+	return &errdetails.ResourceInfo{
+		ResourceType: "topic",
+		ResourceName: topic,
+		Description:  desc,
+	}
+}
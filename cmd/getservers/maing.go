@@ -28,4 +28,10 @@ func main() {
 	for _, server := range res.Servers {
 		fmt.Printf("- %v\n", server)
 	}
+	info, err := client.GetLogInfo(ctx, &api.GetLogInfoRequest{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("log:")
+	fmt.Printf("- %v\n", info.Info)
 }
@@ -6,6 +6,7 @@ import (
 	"os/signal"
 	"path"
 	"syscall"
+	"time"
 
 	"github.com/chmikata/proglog/internal/agent"
 	"github.com/chmikata/proglog/internal/config"
@@ -55,6 +56,19 @@ func setupFlags(cmd *cobra.Command) error {
 	cmd.Flags().Int("rpc-port", 8448, "Port for RPC clients (and Raft) connections.")
 	cmd.Flags().StringSlice("start-join-addrs", nil, "Serf addresses to join.")
 	cmd.Flags().Bool("bootstrap", false, "Bootstrap the cluster.")
+	cmd.Flags().Bool("disable-forwarding", false, "Reply to writes sent to a follower with the leader instead of forwarding them.")
+
+	cmd.Flags().Uint64("retention-max-bytes", 0, "Maximum total bytes of the log before old segments are removed.")
+	cmd.Flags().Duration("retention-max-age", 0, "Maximum age of a segment before it is removed.")
+	cmd.Flags().Bool("compaction", false, "Keep only the latest record for each key.")
+	cmd.Flags().Duration("tombstone-grace", 24*time.Hour, "How long tombstones are kept by compaction.")
+	cmd.Flags().String("compression", "none", "Codec closed segments are compressed with (none, gzip, flate, zlib or lzw).")
+	cmd.Flags().String("sync", "os", "When appends are synced to disk (os, append or periodic).")
+	cmd.Flags().Duration("sync-interval", time.Second, "Interval of the periodic sync.")
+	cmd.Flags().String("partitioner", "hash", "How records are assigned to the partitions of a topic (hash, round-robin or explicit).")
+	cmd.Flags().Duration("snapshot-interval", 2*time.Minute, "How often Raft checks whether to take a snapshot.")
+	cmd.Flags().Uint64("snapshot-threshold", 8192, "Raft log entries since the last snapshot that trigger the next one.")
+	cmd.Flags().Uint64("trailing-logs", 10240, "Raft log entries kept behind a snapshot for followers to catch up from.")
 
 	cmd.Flags().String("acl-model-file", "", "Path to ACl model.")
 	cmd.Flags().String("acl-policy-file", "", "Path to ACL policy.")
@@ -89,6 +103,18 @@ func (c *cli) setupConfig(cmd *cobra.Command, args []string) error {
 	c.cfg.RPCPort = viper.GetInt("rpc-port")
 	c.cfg.StartJoinAddrs = viper.GetStringSlice("start-join-addrs")
 	c.cfg.Bootstrap = viper.GetBool("bootstrap")
+	c.cfg.DisableForwarding = viper.GetBool("disable-forwarding")
+	c.cfg.RetentionMaxBytes = viper.GetUint64("retention-max-bytes")
+	c.cfg.RetentionMaxAge = viper.GetDuration("retention-max-age")
+	c.cfg.Compaction = viper.GetBool("compaction")
+	c.cfg.TombstoneGrace = viper.GetDuration("tombstone-grace")
+	c.cfg.Compression = viper.GetString("compression")
+	c.cfg.Sync = viper.GetString("sync")
+	c.cfg.SyncInterval = viper.GetDuration("sync-interval")
+	c.cfg.Partitioner = viper.GetString("partitioner")
+	c.cfg.SnapshotInterval = viper.GetDuration("snapshot-interval")
+	c.cfg.SnapshotThreshold = viper.GetUint64("snapshot-threshold")
+	c.cfg.TrailingLogs = viper.GetUint64("trailing-logs")
 	c.cfg.ACLModeFile = viper.GetString("acl-mode-file")
 	c.cfg.ACLPolicyFile = viper.GetString("acl-policy-file")
 	c.cfg.ServerTLSConfig.CertFile = viper.GetString("server-tls-cert-file")
@@ -20,6 +20,7 @@ import (
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 type Agent struct {
@@ -28,6 +29,7 @@ type Agent struct {
 	mux        cmux.CMux
 	log        *log.DistributedLog
 	server     *grpc.Server
+	forwarder  *server.Forwarder
 	membership *discovery.Membership
 
 	shutdown     bool
@@ -46,6 +48,23 @@ type Config struct {
 	ACLModeFile     string
 	ACLPolicyFile   string
 	Bootstrap       bool
+
+	RetentionMaxBytes uint64
+	RetentionMaxAge   time.Duration
+	Compaction        bool
+	TombstoneGrace    time.Duration
+	Compression       string
+	Sync              string
+	SyncInterval      time.Duration
+	Partitioner       string
+	DisableForwarding bool
+
+	// SnapshotInterval, SnapshotThreshold and TrailingLogs decide when Raft
+	// takes snapshots and how much of its log it keeps behind them. Zero
+	// values keep Raft's defaults.
+	SnapshotInterval  time.Duration
+	SnapshotThreshold uint64
+	TrailingLogs      uint64
 }
 
 func (c Config) RPCAddr() (string, error) {
@@ -110,7 +129,8 @@ func (a *Agent) setupLog() error {
 		if _, err := reader.Read(b); err != nil {
 			return false
 		}
-		return bytes.Equal(b, []byte{byte(log.RaftRPC)})
+		return bytes.Equal(b, []byte{byte(log.RaftRPC)}) ||
+			bytes.Equal(b, []byte{byte(log.SegmentRPC)})
 	})
 
 	logConfig := log.Config{}
@@ -126,6 +146,26 @@ func (a *Agent) setupLog() error {
 	logConfig.Raft.BindAddr = rpcAddr
 	logConfig.Raft.LocalID = raft.ServerID(a.Config.NodeName)
 	logConfig.Raft.BootStrap = a.Config.Bootstrap
+	logConfig.Raft.SnapshotInterval = a.Config.SnapshotInterval
+	logConfig.Raft.SnapshotThreshold = a.Config.SnapshotThreshold
+	logConfig.Raft.TrailingLogs = a.Config.TrailingLogs
+	logConfig.Retention.MaxBytes = a.Config.RetentionMaxBytes
+	logConfig.Retention.MaxAge = a.Config.RetentionMaxAge
+	logConfig.Compaction.Enabled = a.Config.Compaction
+	logConfig.Compaction.TombstoneGrace = a.Config.TombstoneGrace
+	logConfig.Compression.Codec, err = log.ParseCodec(a.Config.Compression)
+	if err != nil {
+		return err
+	}
+	logConfig.Segment.Sync, err = log.ParseSyncPolicy(a.Config.Sync)
+	if err != nil {
+		return err
+	}
+	logConfig.Segment.SyncInterval = a.Config.SyncInterval
+	logConfig.Partitioner, err = log.ParsePartitioner(a.Config.Partitioner)
+	if err != nil {
+		return err
+	}
 
 	a.log, err = log.NewDistributedLog(
 		a.Config.DataDir,
@@ -146,10 +186,28 @@ func (a *Agent) setupServer() error {
 		a.Config.ACLPolicyFile,
 	)
 	serverConfig := &server.Config{
-		CommitLog:   a.log,
-		Authorizer:  authorizer,
-		GetServerer: a.log,
+		CommitLog:         a.log,
+		Authorizer:        authorizer,
+		GetServerer:       a.log,
+		Leader:            a.log,
+		OffsetCommitter:   a.log,
+		Appender:          a.log,
+		Topics:            a.log,
+		Snapshotter:       a.log,
+		DisableForwarding: a.Config.DisableForwarding,
+	}
+	if a.Config.PeerTLSConfig != nil {
+		a.forwarder = server.NewForwarder(
+			grpc.WithTransportCredentials(
+				credentials.NewTLS(a.Config.PeerTLSConfig),
+			),
+		)
+	} else {
+		a.forwarder = server.NewForwarder(
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
 	}
+	serverConfig.Forwarder = a.forwarder
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
 		creds := credentials.NewTLS(a.Config.ServerTLSConfig)
@@ -208,6 +266,7 @@ func (a *Agent) Shutdown() error {
 			a.server.GracefulStop()
 			return nil
 		},
+		a.forwarder.Close,
 		a.log.Close,
 	}
 	for _, fn := range shutdown {
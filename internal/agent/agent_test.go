@@ -110,10 +110,51 @@ func TestAgent(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, consumeResponse.Record.Value, []byte("foo"))
 
+	rpcAddr, err := agents[1].Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		rpcAddr,
+		grpc.WithTransportCredentials(credentials.NewTLS(peerTLSConfig)),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	forwardResponse, err := api.NewLogClient(conn).Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("bar"),
+			},
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, produceResponse.Offset+1, forwardResponse.Offset)
+
+	// Followers forward linearizable reads to the leader too.
+	consumeResponse, err = api.NewLogClient(conn).Consume(
+		context.Background(),
+		&api.ConsumeRequest{
+			Offset:      forwardResponse.Offset,
+			Consistency: api.ReadConsistency_READ_LINEARIZABLE,
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, consumeResponse.Record.Value, []byte("bar"))
+
+	consumeResponse, err = leaderClient.Consume(
+		context.Background(),
+		&api.ConsumeRequest{
+			Offset:      forwardResponse.Offset,
+			Consistency: api.ReadConsistency_READ_AT_LEAST_OFFSET,
+			MinOffset:   forwardResponse.Offset,
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, consumeResponse.Record.Value, []byte("bar"))
+
 	consumeResponse, err = leaderClient.Consume(
 		context.Background(),
 		&api.ConsumeRequest{
-			Offset: produceResponse.Offset + 1,
+			Offset: forwardResponse.Offset + 1,
 		},
 	)
 	require.Nil(t, consumeResponse)
@@ -41,9 +41,15 @@ func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	defer p.mu.Unlock()
 	var result balancer.PickResult
 	if strings.Contains(info.FullMethodName, "Produce") ||
+		strings.Contains(info.FullMethodName, "GetLogInfo") ||
+		strings.Contains(info.FullMethodName, "CommitOffset") ||
+		strings.Contains(info.FullMethodName, "FetchOffset") ||
+		strings.Contains(info.FullMethodName, "Topic") ||
+		strings.Contains(info.FullMethodName, "Snapshot") ||
 		len(p.followers) == 0 {
 		result.SubConn = p.leader
-	} else if strings.Contains(info.FullMethodName, "Consume") {
+	} else if strings.Contains(info.FullMethodName, "Consume") ||
+		strings.Contains(info.FullMethodName, "OffsetForTime") {
 		result.SubConn = p.nextFollower()
 	}
 	if result.SubConn == nil {
@@ -28,13 +28,23 @@ func TestPickerNoSubConnAvailable(t *testing.T) {
 
 func TestPickerProduceToLeader(t *testing.T) {
 	picker, subConns := setupTest()
-	info := balancer.PickInfo{
-		FullMethodName: "/log.vX.Log/Produce",
-	}
-	for i := 0; i < 5; i++ {
-		gotPick, err := picker.Pick(info)
-		require.NoError(t, err)
-		require.Equal(t, subConns[0], gotPick.SubConn)
+	for _, method := range []string{
+		"/log.vX.Log/Produce",
+		"/log.vX.Log/GetLogInfo",
+		"/log.vX.Log/CommitOffset",
+		"/log.vX.Log/FetchOffset",
+		"/log.vX.Log/CreateTopic",
+		"/log.vX.Log/ListTopics",
+		"/log.vX.Log/Snapshot",
+	} {
+		info := balancer.PickInfo{
+			FullMethodName: method,
+		}
+		for i := 0; i < 5; i++ {
+			gotPick, err := picker.Pick(info)
+			require.NoError(t, err)
+			require.Equal(t, subConns[0], gotPick.SubConn)
+		}
 	}
 }
 
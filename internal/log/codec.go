@@ -0,0 +1,186 @@
+package log
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/lzw"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// Codec is the compression applied to the records of a closed segment. A
+// compressed segment packs its records into blocks compressed as one, and
+// the header of its store names the codec, so segments written with
+// different codecs can be read side by side.
+type Codec uint8
+
+const (
+	CodecNone Codec = iota
+	CodecGzip
+	CodecFlate
+	CodecZlib
+	CodecLZW
+)
+
+var codecNames = map[Codec]string{
+	CodecNone:  "none",
+	CodecGzip:  "gzip",
+	CodecFlate: "flate",
+	CodecZlib:  "zlib",
+	CodecLZW:   "lzw",
+}
+
+// ParseCodec returns the codec with the given name.
+func ParseCodec(name string) (Codec, error) {
+	if name == "" {
+		return CodecNone, nil
+	}
+	for c, n := range codecNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown codec: %q", name)
+}
+
+func (c Codec) String() string {
+	if n, ok := codecNames[c]; ok {
+		return n
+	}
+	return fmt.Sprintf("codec(%d)", uint8(c))
+}
+
+func (c Codec) compress(p []byte) ([]byte, error) {
+	var (
+		buf bytes.Buffer
+		w   io.WriteCloser
+		err error
+	)
+	switch c {
+	case CodecNone:
+		return p, nil
+	case CodecGzip:
+		w = gzip.NewWriter(&buf)
+	case CodecFlate:
+		w, err = flate.NewWriter(&buf, flate.DefaultCompression)
+	case CodecZlib:
+		w = zlib.NewWriter(&buf)
+	case CodecLZW:
+		w = lzw.NewWriter(&buf, lzw.LSB, 8)
+	default:
+		return nil, fmt.Errorf("unknown codec: %s", c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c Codec) decompress(p []byte) ([]byte, error) {
+	var (
+		r   io.ReadCloser
+		err error
+	)
+	switch c {
+	case CodecNone:
+		return p, nil
+	case CodecGzip:
+		r, err = gzip.NewReader(bytes.NewReader(p))
+	case CodecFlate:
+		r = flate.NewReader(bytes.NewReader(p))
+	case CodecZlib:
+		r, err = zlib.NewReader(bytes.NewReader(p))
+	case CodecLZW:
+		r = lzw.NewReader(bytes.NewReader(p), lzw.LSB, 8)
+	default:
+		return nil, fmt.Errorf("unknown codec: %s", c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// blockBytes is the size of the records packed into one block of a
+// compressed segment, before compression. Reading a record decompresses
+// its whole block.
+const blockBytes = 16 << 10
+
+// appendFrame appends p to b with the length prefix of a store record.
+func appendFrame(b, p []byte) []byte {
+	b = enc.AppendUint64(b, encodeLen(p))
+	return append(b, p...)
+}
+
+// splitFrames splits a block into the records it packs.
+func splitFrames(b []byte) ([][]byte, error) {
+	var frames [][]byte
+	for len(b) > 0 {
+		if len(b) < lenWidth {
+			return nil, io.ErrUnexpectedEOF
+		}
+		size, sum, checked := decodeLen(enc.Uint64(b))
+		if size > uint64(len(b)-lenWidth) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		p := b[lenWidth : lenWidth+size]
+		if !validRecord(p, sum, checked) {
+			return nil, fmt.Errorf("block record: checksum mismatch")
+		}
+		frames = append(frames, p)
+		b = b[lenWidth+size:]
+	}
+	return frames, nil
+}
+
+// decodingReader turns the records of a store into those of an
+// uncompressed store, so consumers of Log.Reader never see a codec. The
+// records of an uncompressed store are passed through as they are.
+type decodingReader struct {
+	r     io.Reader
+	codec Codec
+	buf   bytes.Buffer
+}
+
+func (d *decodingReader) Read(p []byte) (int, error) {
+	if d.codec == CodecNone {
+		return d.r.Read(p)
+	}
+	for d.buf.Len() == 0 {
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	return d.buf.Read(p)
+}
+
+// next decompresses the next block. Its records are already framed.
+func (d *decodingReader) next() error {
+	hdr := make([]byte, lenWidth)
+	if _, err := io.ReadFull(d.r, hdr); err != nil {
+		return err
+	}
+	size, sum, checked := decodeLen(enc.Uint64(hdr))
+	p := make([]byte, size)
+	if _, err := io.ReadFull(d.r, p); err != nil {
+		return err
+	}
+	if !validRecord(p, sum, checked) {
+		return fmt.Errorf("compressed block: checksum mismatch")
+	}
+	p, err := d.codec.decompress(p)
+	if err != nil {
+		return err
+	}
+	d.buf.Write(p)
+	return nil
+}
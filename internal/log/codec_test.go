@@ -0,0 +1,90 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/chmikata/proglog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCodec(t *testing.T) {
+	p := []byte(strings.Repeat(`{"name":"proglog","kind":"record"}`, 8))
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecFlate, CodecZlib, CodecLZW} {
+		codec := codec
+		t.Run(codec.String(), func(t *testing.T) {
+			got, err := ParseCodec(codec.String())
+			assert.NoError(t, err)
+			assert.Equal(t, codec, got)
+
+			compressed, err := codec.compress(p)
+			assert.NoError(t, err)
+			if codec != CodecNone {
+				assert.Less(t, len(compressed), len(p))
+			}
+			decompressed, err := codec.decompress(compressed)
+			assert.NoError(t, err)
+			assert.Equal(t, p, decompressed)
+		})
+	}
+	_, err := ParseCodec("snappy")
+	assert.Error(t, err)
+}
+
+func TestLog_compression(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "TestLog_compression")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c := Config{}
+	c.Segment.MaxIndexBytes = 36
+	c.Compression.Codec = CodecGzip
+	c.Compaction.CheckInterval = time.Hour
+	log, _ := NewLog(dir, c)
+	value := []byte(strings.Repeat(`{"name":"proglog"}`, 16))
+	for i := 0; i < 4; i++ {
+		log.Append(&api.Record{Value: value})
+	}
+	before := log.segments[0].store.size
+	assert.NoError(t, log.Compact(time.Now()))
+	assert.Less(t, log.segments[0].store.size, before)
+	assert.Equal(t, CodecGzip, log.segments[0].store.codec)
+
+	check := func(log *Log) {
+		for off := uint64(0); off < 4; off++ {
+			record, err := log.Read(off)
+			if assert.NoError(t, err) {
+				assert.Equal(t, value, record.Value)
+			}
+		}
+		b, err := io.ReadAll(log.Reader())
+		assert.NoError(t, err)
+		for off := uint64(0); len(b) > 0; off++ {
+			size, _, checked := decodeLen(enc.Uint64(b))
+			assert.True(t, checked)
+			record := &api.Record{}
+			assert.NoError(t, proto.Unmarshal(b[lenWidth:lenWidth+size], record))
+			assert.Equal(t, off, record.Offset)
+			assert.True(t, bytes.Equal(value, record.Value))
+			b = b[lenWidth+size:]
+		}
+	}
+	check(log)
+	assert.NoError(t, log.Close())
+
+	c.Compression.Codec = CodecNone
+	log, err := NewLog(dir, c)
+	assert.NoError(t, err)
+	check(log)
+	assert.NoError(t, log.RebuildIndex())
+	check(log)
+
+	assert.NoError(t, log.Compact(time.Now()))
+	assert.Equal(t, CodecNone, log.segments[0].store.codec)
+	assert.Equal(t, before, log.segments[0].store.size)
+	check(log)
+	assert.NoError(t, log.Close())
+}
@@ -0,0 +1,282 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	api "github.com/chmikata/proglog/api/v1"
+	"go.uber.org/zap"
+)
+
+// compactDir prefixes the directory, inside the log directory, that a
+// compaction rewrites segments into before they replace the originals.
+const compactDir = ".compact"
+
+// Compact rewrites the closed segments so that only the latest record for
+// each key is kept. Records without a key are always kept and tombstones,
+// records with a key and an empty value, are dropped once they are older
+// than the tombstone grace period. Records keep their offsets, so compacted
+// segments have gaps. Segments not yet written with the configured codec
+// are compressed on the way.
+func (l *Log) Compact(now time.Time) error {
+	if !l.Config.Compaction.Enabled {
+		return l.compact(0, now, 0)
+	}
+	horizon, _ := l.compactionHorizon()
+	return l.compact(horizon, now, l.Config.Compaction.TombstoneGrace)
+}
+
+// compactionHorizon returns the base offset of the active segment, below
+// which records may be compacted, and whether any segment is closed.
+func (l *Log) compactionHorizon() (uint64, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.baseOffset, len(l.segments) > 1
+}
+
+// uncompressed reports whether a closed segment isn't written with the
+// configured codec.
+func (l *Log) uncompressed() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if s.store.codec != l.Config.Compression.Codec {
+			return true
+		}
+	}
+	return false
+}
+
+// compact compacts the records below horizon as Compact does, aging
+// tombstones from now. Replicas that apply it at the same point of the log
+// compact the same offsets.
+func (l *Log) compact(horizon uint64, now time.Time, grace time.Duration) error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	dir, err := os.MkdirTemp(l.Dir, compactDir)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	l.mu.RLock()
+	closed := make([]*segment, len(l.segments)-1)
+	copy(closed, l.segments)
+	l.mu.RUnlock()
+
+	var latest map[string]uint64
+	if horizon > 0 {
+		if latest, err = l.latestOffsets(); err != nil {
+			return err
+		}
+	}
+	keep := func(record *api.Record) bool {
+		if record.Offset >= horizon || len(record.Key) == 0 {
+			return true
+		}
+		if latest[string(record.Key)] != record.Offset {
+			return false
+		}
+		if len(record.Value) != 0 {
+			return true
+		}
+		age := now.Sub(time.Unix(0, record.Timestamp))
+		return age <= grace
+	}
+	for _, s := range closed {
+		if err := l.compactSegment(s, dir, keep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// latestOffsets returns the offset of the latest record for every key in
+// the log. It holds the read lock one segment at a time, so appends aren't
+// held up for the whole scan.
+func (l *Log) latestOffsets() (map[string]uint64, error) {
+	l.mu.RLock()
+	segments := make([]*segment, len(l.segments))
+	copy(segments, l.segments)
+	l.mu.RUnlock()
+
+	latest := make(map[string]uint64)
+	for _, s := range segments {
+		if err := l.scanKeys(s, latest); err != nil {
+			return nil, err
+		}
+	}
+	return latest, nil
+}
+
+// scanKeys adds the keys of the records of s to latest.
+func (l *Log) scanKeys(s *segment, latest map[string]uint64) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.indexOf(s) < 0 {
+		// Removed by retention since the scan started.
+		return nil
+	}
+	for i := int64(0); i < int64(s.index.size/entWidth); i++ {
+		record, err := s.readEntry(i)
+		if err != nil {
+			return err
+		}
+		if len(record.Key) != 0 {
+			latest[string(record.Key)] = record.Offset
+		}
+	}
+	return nil
+}
+
+// compactSegment writes the records of s that keep accepts to a new segment
+// in dir and swaps it in for s. Segments with nothing to drop are left as
+// they are. If the swap fails, the files of s are put back and s stays in
+// the log.
+func (l *Log) compactSegment(
+	s *segment,
+	dir string,
+	keep func(*api.Record) bool,
+) error {
+	rewritten, dropped, err := l.rewriteSegment(s, dir, keep)
+	if err != nil || rewritten == nil {
+		return err
+	}
+	if err := rewritten.Sync(); err != nil {
+		return err
+	}
+	if err := rewritten.Close(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := l.indexOf(s)
+	if i < 0 {
+		// Removed by retention while it was being rewritten; the rewritten
+		// files go with the compaction directory.
+		return nil
+	}
+	// s keeps reading the files it has open until it is closed, while
+	// links to them in dir let them be put back.
+	names := []string{s.timeIndex.Name(), s.index.Name(), s.store.Name()}
+	for _, name := range names {
+		if err := os.Link(name, filepath.Join(dir, filepath.Base(name)+".orig")); err != nil {
+			return err
+		}
+	}
+	swapped := 0
+	restore := func(err error) error {
+		for _, name := range names[:swapped] {
+			orig := filepath.Join(dir, filepath.Base(name)+".orig")
+			if rerr := os.Rename(orig, name); rerr != nil {
+				return fmt.Errorf("%w; restore %s: %v", err, name, rerr)
+			}
+		}
+		return err
+	}
+	for _, name := range []string{
+		rewritten.timeIndex.Name(),
+		rewritten.index.Name(),
+		rewritten.store.Name(),
+	} {
+		if err := os.Rename(name, filepath.Join(l.Dir, filepath.Base(name))); err != nil {
+			return restore(err)
+		}
+		swapped++
+	}
+	ns, err := newSegment(l.Dir, s.baseOffset, l.Config)
+	if err != nil {
+		return restore(err)
+	}
+	ns.nextOffset = s.nextOffset
+	l.segments[i] = ns
+	if err := s.Close(); err != nil {
+		return err
+	}
+	zap.L().Named("log").Info(
+		"compacted segment",
+		zap.Uint64("base_offset", s.baseOffset),
+		zap.Int("dropped_records", dropped),
+		zap.Stringer("codec", l.Config.Compression.Codec),
+	)
+	return nil
+}
+
+// rewriteSegment copies the records of s that keep accepts to a new segment
+// in dir. It returns nil if every record would be kept and s already uses
+// the configured codec.
+func (l *Log) rewriteSegment(
+	s *segment,
+	dir string,
+	keep func(*api.Record) bool,
+) (*segment, int, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.indexOf(s) < 0 {
+		return nil, 0, nil
+	}
+	entries := int64(s.index.size / entWidth)
+	var records []*api.Record
+	for i := int64(0); i < entries; i++ {
+		record, err := s.readEntry(i)
+		if err != nil {
+			return nil, 0, err
+		}
+		if keep(record) {
+			records = append(records, record)
+		}
+	}
+	dropped := int(entries) - len(records)
+	if dropped == 0 && s.store.codec == l.Config.Compression.Codec {
+		return nil, 0, nil
+	}
+	rewritten, err := newSegment(dir, s.baseOffset, l.Config)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := rewritten.writeRecords(records); err != nil {
+		_ = rewritten.Remove()
+		return nil, 0, fmt.Errorf("rewrite segment %d: %w", s.baseOffset, err)
+	}
+	return rewritten, dropped, nil
+}
+
+func (l *Log) indexOf(s *segment) int {
+	for i, seg := range l.segments {
+		if seg == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *Log) compactPeriodically(done <-chan struct{}) {
+	defer l.wg.Done()
+
+	interval := l.Config.Compaction.CheckInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if err := l.Compact(now); err != nil {
+				zap.L().Named("log").Error(
+					"failed to compact log",
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/chmikata/proglog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_Compact(t *testing.T) {
+	now := time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC)
+	newTestLog := func(grace time.Duration) *Log {
+		dir, _ := os.MkdirTemp("", "TestLog_Compact")
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		c := Config{}
+		c.Segment.MaxIndexBytes = 36
+		c.Compaction.Enabled = true
+		c.Compaction.TombstoneGrace = grace
+		log, _ := NewLog(dir, c)
+		for _, kv := range [][2]string{
+			{"a", "1"}, {"b", "1"}, {"a", "2"},
+			{"c", "1"}, {"b", ""}, {"", "no key"},
+			{"a", "3"},
+		} {
+			log.Append(&api.Record{
+				Key:       []byte(kv[0]),
+				Value:     []byte(kv[1]),
+				Timestamp: now.Add(-2 * time.Hour).UnixNano(),
+			})
+		}
+		return log
+	}
+	tests := []struct {
+		name      string
+		log       *Log
+		kept      []uint64
+		compacted []uint64
+	}{
+		{
+			name:      "ok case tombstone expired",
+			log:       newTestLog(time.Hour),
+			kept:      []uint64{3, 5, 6},
+			compacted: []uint64{0, 1, 2, 4},
+		},
+		{
+			name:      "ok case tombstone within grace",
+			log:       newTestLog(24 * time.Hour),
+			kept:      []uint64{3, 4, 5, 6},
+			compacted: []uint64{0, 1, 2},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			assert.NoError(t, tt.log.Compact(now))
+			check := func(log *Log) {
+				for _, off := range tt.kept {
+					record, err := log.Read(off)
+					if assert.NoError(t, err) {
+						assert.Equal(t, off, record.Offset)
+					}
+				}
+				for _, off := range tt.compacted {
+					_, err := log.Read(off)
+					assert.Equal(t, api.ErrOffsetCompacted{Offset: off}, err)
+				}
+				_, err := log.Read(7)
+				assert.IsType(t, api.ErrOffsetOutOfRange{}, err)
+			}
+			check(tt.log)
+
+			assert.NoError(t, tt.log.Close())
+			log, err := NewLog(tt.log.Dir, tt.log.Config)
+			assert.NoError(t, err)
+			check(log)
+			off, err := log.Append(&api.Record{Value: []byte("next")})
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(7), off)
+			assert.NoError(t, log.Close())
+		})
+	}
+}
+
+func TestLog_CompactConcurrently(t *testing.T) {
+	now := time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC)
+	dir, err := os.MkdirTemp("", "TestLog_CompactConcurrently")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = 4 * entWidth
+	c.Compression.Codec = CodecGzip
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 30; i++ {
+		_, err := log.Append(&api.Record{
+			Key:   []byte(fmt.Sprintf("key %d", i%10)),
+			Value: []byte("value"),
+		})
+		require.NoError(t, err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(compacted bool) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				horizon := uint64(0)
+				if compacted {
+					horizon, _ = log.compactionHorizon()
+				}
+				errs <- log.compact(horizon, now, 0)
+			}
+		}(i%2 == 0)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	for off := uint64(20); off < 30; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, compactDir+"*"))
+	require.NoError(t, err)
+	require.Empty(t, matches)
+}
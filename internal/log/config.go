@@ -1,6 +1,9 @@
 package log
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/hashicorp/raft"
 )
 
@@ -15,5 +18,75 @@ type Config struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		Sync          SyncPolicy
+		SyncInterval  time.Duration
+	}
+	Retention struct {
+		MaxBytes      uint64
+		MaxAge        time.Duration
+		CheckInterval time.Duration
+	}
+	Compaction struct {
+		Enabled        bool
+		TombstoneGrace time.Duration
+		CheckInterval  time.Duration
+	}
+	Compression struct {
+		Codec Codec
+	}
+	// Partitioner chooses the partitions of records produced to topics with
+	// more than one partition; a HashPartitioner if nil.
+	Partitioner Partitioner
+	// ProducerExpiry is how many Raft entries an idempotent producer is
+	// remembered for after it was last used; defaultProducerExpiry if zero.
+	ProducerExpiry uint64
+
+	// replicated logs leave compaction, compression included, to Raft.
+	replicated bool
+}
+
+// defaultProducerExpiry forgets producers that sat out about a million
+// writes.
+const defaultProducerExpiry = 1 << 20
+
+// SyncPolicy decides when appended records are committed to disk.
+type SyncPolicy uint8
+
+const (
+	// SyncOS leaves flushing to the operating system.
+	SyncOS SyncPolicy = iota
+	// SyncEveryAppend commits every append before it returns.
+	SyncEveryAppend
+	// SyncPeriodic commits every Segment.SyncInterval in the background.
+	SyncPeriodic
+)
+
+var syncPolicyNames = map[SyncPolicy]string{
+	SyncOS:          "os",
+	SyncEveryAppend: "append",
+	SyncPeriodic:    "periodic",
+}
+
+// ParseSyncPolicy returns the sync policy with the given name.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	if name == "" {
+		return SyncOS, nil
+	}
+	for p, n := range syncPolicyNames {
+		if n == name {
+			return p, nil
+		}
 	}
+	return 0, fmt.Errorf("unknown sync policy: %q", name)
+}
+
+func (p SyncPolicy) String() string {
+	if n, ok := syncPolicyNames[p]; ok {
+		return n
+	}
+	return fmt.Sprintf("sync(%d)", uint8(p))
+}
+
+func (c Config) retentionEnabled() bool {
+	return c.Retention.MaxBytes != 0 || c.Retention.MaxAge != 0
 }
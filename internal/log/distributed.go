@@ -1,26 +1,50 @@
 package log
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	api "github.com/chmikata/proglog/api/v1"
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 )
 
 type DistributedLog struct {
-	config  Config
-	log     *Log
-	raftLog *logStore
-	raft    *raft.Raft
+	config      Config
+	log         *Log
+	topics      *Topics
+	partitioner Partitioner
+	fsm         *fsm
+	raftLog     *logStore
+	snapshots   raft.SnapshotStore
+	raft        *raft.Raft
+	// barrierTerm is the last term a linearizable read waited on a barrier
+	// in; until the leader commits an entry of its own term, its commit
+	// index may lag behind what earlier leaders committed.
+	barrierTerm uint64
+
+	// done stops the background work the leader drives through Raft. It
+	// is nil until the log is set up and after it is closed.
+	mu         sync.Mutex
+	done       chan struct{}
+	wg         sync.WaitGroup
+	retaining  bool
+	compacting bool
 }
 
 func NewDistributedLog(dataDir string, config Config) (
@@ -28,7 +52,11 @@ func NewDistributedLog(dataDir string, config Config) (
 	error,
 ) {
 	l := &DistributedLog{
-		config: config,
+		config:      config,
+		partitioner: config.Partitioner,
+	}
+	if l.partitioner == nil {
+		l.partitioner = &HashPartitioner{}
 	}
 	if err := l.setupLog(dataDir); err != nil {
 		return nil, err
@@ -36,26 +64,99 @@ func NewDistributedLog(dataDir string, config Config) (
 	if err := l.setupRaft(dataDir); err != nil {
 		return nil, err
 	}
+	l.mu.Lock()
+	l.done = make(chan struct{})
+	l.mu.Unlock()
+	l.startWork()
 	return l, nil
 }
 
+// startWork starts the background work that the node or its topics ask
+// for and that isn't running yet. It runs again whenever topics change.
+func (l *DistributedLog) startWork() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done == nil {
+		return
+	}
+	if !l.retaining && l.retentionEnabled() {
+		l.retaining = true
+		l.wg.Add(1)
+		go l.enforceRetention(l.done)
+	}
+	if !l.compacting && l.compactionEnabled() {
+		l.compacting = true
+		l.wg.Add(1)
+		go l.compactPeriodically(l.done)
+	}
+}
+
+// retentionEnabled reports whether the node or any topic sets a retention
+// limit.
+func (l *DistributedLog) retentionEnabled() bool {
+	if l.config.retentionEnabled() {
+		return true
+	}
+	for _, topic := range l.topics.List() {
+		if retentionConfig(l.config, topic.Config).retentionEnabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// compactionEnabled reports whether the node or any topic compacts or
+// compresses its segments.
+func (l *DistributedLog) compactionEnabled() bool {
+	if l.config.Compaction.Enabled ||
+		l.config.Compression.Codec != CodecNone {
+		return true
+	}
+	for _, topic := range l.topics.List() {
+		if topic.Config.Compaction {
+			return true
+		}
+	}
+	return false
+}
+
 func (l *DistributedLog) setupLog(dataDir string) error {
 	logDir := filepath.Join(dataDir, "log")
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return err
 	}
+	// Retention goes through Raft so every replica drops the same records.
+	logConfig := l.config
+	logConfig.Retention.MaxBytes = 0
+	logConfig.Retention.MaxAge = 0
+	logConfig.Compaction.Enabled = false
+	logConfig.replicated = true
 	var err error
-	l.log, err = NewLog(logDir, l.config)
+	l.log, err = NewLog(logDir, logConfig)
 	if err != nil {
 		return err
 	}
-	return nil
+	l.topics, err = newTopics(
+		filepath.Join(dataDir, "topics"),
+		logConfig,
+		true,
+	)
+	return err
 }
 
 func (l *DistributedLog) setupRaft(dataDir string) error {
 	var err error
 
-	fsm := &fsm{log: l.log}
+	l.fsm = &fsm{
+		log:       l.log,
+		topics:    l.topics,
+		offsets:   make(map[string]uint64),
+		producers: make(map[uint64]*producerState),
+		keys:      make(map[partitionID]map[string]uint64),
+		segments:  filepath.Join(dataDir, "raft", "segments"),
+		addr:      l.config.Raft.BindAddr,
+		changed:   l.startWork,
+	}
 
 	logDir := filepath.Join(dataDir, "raft", "log")
 	if err := os.MkdirAll(logDir, 0755); err != nil {
@@ -63,6 +164,10 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	}
 	logConfig := l.config
 	logConfig.Segment.InitialOffset = 1
+	logConfig.Retention.MaxBytes = 0
+	logConfig.Retention.MaxAge = 0
+	logConfig.Compaction.Enabled = false
+	logConfig.Compression.Codec = CodecNone
 	l.raftLog, err = newLogSotre(logDir, logConfig)
 	if err != nil {
 		return err
@@ -84,9 +189,15 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	if err != nil {
 		return err
 	}
+	l.snapshots = snapshotStore
 
 	maxPool := 5
 	timeout := 10 * time.Second
+	streamLayer := l.config.Raft.StreamLayer
+	l.fsm.dial = func(addr string) (net.Conn, error) {
+		return streamLayer.dial(addr, SegmentRPC, timeout)
+	}
+	streamLayer.segments = l.fsm.serveSegment
 	transport := raft.NewNetworkTransport(
 		l.config.Raft.StreamLayer,
 		maxPool,
@@ -108,10 +219,19 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	if l.config.Raft.CommitTimeout != 0 {
 		config.CommitTimeout = l.config.Raft.CommitTimeout
 	}
+	if l.config.Raft.SnapshotInterval != 0 {
+		config.SnapshotInterval = l.config.Raft.SnapshotInterval
+	}
+	if l.config.Raft.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = l.config.Raft.SnapshotThreshold
+	}
+	if l.config.Raft.TrailingLogs != 0 {
+		config.TrailingLogs = l.config.Raft.TrailingLogs
+	}
 
 	l.raft, err = raft.NewRaft(
 		config,
-		fsm,
+		l.fsm,
 		l.raftLog,
 		stableStore,
 		snapshotStore,
@@ -144,14 +264,375 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 }
 
 func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	res, err := l.AppendRequest(&api.ProduceRequest{Record: record})
+	if err != nil {
+		return 0, err
+	}
+	return res.Offset, nil
+}
+
+// AppendRequest appends the record of req, honouring its options:
+//   - A record of a registered producer whose sequence number was already
+//     appended returns the offset it was appended at instead of being
+//     appended again.
+//   - A conditional append fails with ErrConditionFailed unless the
+//     expected offsets still hold when the record is applied.
+//   - A record of a topic with several partitions is appended to the
+//     partition it names, or else the one the partitioner chooses.
+//
+// The record ends up in the partition of the response.
+func (l *DistributedLog) AppendRequest(req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	// Stamped before applying so every replica records the same time.
+	if req.Record.Timestamp == 0 {
+		req.Record.Timestamp = time.Now().UnixNano()
+	}
+	if err := l.partition(req); err != nil {
+		return nil, err
+	}
+	res, err := l.apply(AppendRequestType, req)
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.ProduceResponse), nil
+}
+
+// partition sets the partition of req. It is chosen before the request is
+// replicated so that every replica appends the record to the same one.
+func (l *DistributedLog) partition(req *api.ProduceRequest) error {
+	if req.Partition != nil {
+		return nil
+	}
+	partitions := uint32(1)
+	if req.Topic != "" {
+		config, err := l.topics.config(req.Topic)
+		if err != nil {
+			return err
+		}
+		partitions = partitionCount(config)
+	}
+	var p uint32
+	if partitions > 1 {
+		var err error
+		if p, err = l.partitioner.Partition(req, partitions); err != nil {
+			return err
+		}
+	}
+	req.Partition = &p
+	return nil
+}
+
+// AppendBatch appends records with a single Raft command and returns the
+// offset of the first.
+func (l *DistributedLog) AppendBatch(records []*api.Record) (uint64, error) {
+	res, err := l.AppendBatchRequest(&api.ProduceBatchRequest{Records: records})
+	if err != nil {
+		return 0, err
+	}
+	return res.FirstOffset, nil
+}
+
+// AppendBatchRequest appends the records of req to one partition with a
+// single Raft command. The partition is chosen for the first record when
+// req names none.
+func (l *DistributedLog) AppendBatchRequest(req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	if len(req.Records) == 0 {
+		return nil, fmt.Errorf("empty batch")
+	}
+	now := time.Now().UnixNano()
+	for _, record := range req.Records {
+		if record.Timestamp == 0 {
+			record.Timestamp = now
+		}
+	}
+	if req.Topic != "" && req.Partition == nil {
+		first := &api.ProduceRequest{Record: req.Records[0], Topic: req.Topic}
+		if err := l.partition(first); err != nil {
+			return nil, err
+		}
+		req.Partition = first.Partition
+	}
+	res, err := l.apply(AppendBatchRequestType, req)
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.ProduceBatchResponse), nil
+}
+
+// CommitOffset records the offset a consumer group will consume next. The
+// offsets are part of the replicated state and included in snapshots.
+func (l *DistributedLog) CommitOffset(group string, off uint64) error {
+	_, err := l.apply(
+		CommitOffsetRequestType,
+		&api.CommitOffsetRequest{Group: group, Offset: off},
+	)
+	return err
+}
+
+// RegisterProducer assigns a new producer ID for AppendRequest.
+func (l *DistributedLog) RegisterProducer() (uint64, error) {
 	res, err := l.apply(
-		AppendRequestType,
-		&api.ProduceRequest{Record: record},
+		RegisterProducerRequestType,
+		&RegisterProducerRequest{Expiry: l.producerExpiry()},
 	)
 	if err != nil {
 		return 0, err
 	}
-	return res.(*api.ProduceResponse).Offset, nil
+	return res.(*api.RegisterProducerResponse).ProducerId, nil
+}
+
+func (l *DistributedLog) producerExpiry() uint64 {
+	if l.config.ProducerExpiry == 0 {
+		return defaultProducerExpiry
+	}
+	return l.config.ProducerExpiry
+}
+
+// CreateTopic creates a topic on every replica.
+func (l *DistributedLog) CreateTopic(name string, config *api.TopicConfig) error {
+	_, err := l.apply(
+		CreateTopicRequestType,
+		&api.CreateTopicRequest{Topic: &api.Topic{Name: name, Config: config}},
+	)
+	return err
+}
+
+// DeleteTopic removes a topic and its records from every replica.
+func (l *DistributedLog) DeleteTopic(name string) error {
+	_, err := l.apply(
+		DeleteTopicRequestType,
+		&api.DeleteTopicRequest{Name: name},
+	)
+	return err
+}
+
+// ListTopics returns the topics on this node.
+func (l *DistributedLog) ListTopics() ([]*api.Topic, error) {
+	return l.topics.List(), nil
+}
+
+// ReadTopic reads the record at off of a partition of a topic.
+func (l *DistributedLog) ReadTopic(topic string, partition uint32, off uint64) (*api.Record, error) {
+	log, err := l.topics.Get(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return log.Read(off)
+}
+
+// ReadTopicBatch reads consecutive records of a partition of a topic as
+// ReadBatch does.
+func (l *DistributedLog) ReadTopicBatch(topic string, partition uint32, off uint64, maxRecords int, maxBytes uint64) ([]*api.Record, error) {
+	log, err := l.topics.Get(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return log.ReadBatch(off, maxRecords, maxBytes)
+}
+
+// TopicOffsetForTime returns the first offset of a partition of a topic
+// whose record was appended at or after t.
+func (l *DistributedLog) TopicOffsetForTime(topic string, partition uint32, t time.Time) (uint64, error) {
+	log, err := l.topics.Get(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	return log.OffsetForTime(t)
+}
+
+// TopicInfo describes a partition of a topic as Info does the default log.
+func (l *DistributedLog) TopicInfo(topic string, partition uint32) (*api.LogInfo, error) {
+	log, err := l.topics.Get(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return l.info(log)
+}
+
+// WaitForTopicOffset blocks until the record at off of a partition of a
+// topic has been applied to this node or ctx is done.
+func (l *DistributedLog) WaitForTopicOffset(ctx context.Context, topic string, partition uint32, off uint64) error {
+	log, err := l.topics.Get(topic, partition)
+	if err != nil {
+		return err
+	}
+	return log.WaitForOffset(ctx, off)
+}
+
+// FetchOffset returns the offset group last committed on this node.
+func (l *DistributedLog) FetchOffset(group string) (uint64, error) {
+	return l.fsm.offset(group)
+}
+
+// ReadBarrier returns once a read at the given consistency may proceed on
+// this node. Linearizable reads are only served by the leader: it confirms
+// it is still the leader and waits until everything committed before the
+// read has been applied. Followers return raft.ErrNotLeader.
+func (l *DistributedLog) ReadBarrier(
+	ctx context.Context,
+	consistency api.ReadConsistency,
+	minOffset uint64,
+) error {
+	switch consistency {
+	case api.ReadConsistency_READ_LINEARIZABLE:
+		return l.readIndex()
+	case api.ReadConsistency_READ_AT_LEAST_OFFSET:
+		return l.log.WaitForOffset(ctx, minOffset)
+	}
+	return nil
+}
+
+func (l *DistributedLog) readIndex() error {
+	if err := l.raft.VerifyLeader().Error(); err != nil {
+		return err
+	}
+	stats := l.raft.Stats()
+	term, err := strconv.ParseUint(stats["term"], 10, 64)
+	if err != nil {
+		return err
+	}
+	if atomic.LoadUint64(&l.barrierTerm) == term {
+		commitIndex, err := strconv.ParseUint(stats["commit_index"], 10, 64)
+		if err != nil {
+			return err
+		}
+		if l.raft.AppliedIndex() >= commitIndex {
+			return nil
+		}
+	}
+	if err := l.raft.Barrier(10 * time.Second).Error(); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&l.barrierTerm, term)
+	return nil
+}
+
+// WaitForOffset blocks until the record at off has been applied to this
+// node's log or ctx is done.
+func (l *DistributedLog) WaitForOffset(ctx context.Context, off uint64) error {
+	return l.log.WaitForOffset(ctx, off)
+}
+
+func (l *DistributedLog) enforceRetention(done <-chan struct{}) {
+	defer l.wg.Done()
+
+	interval := l.config.Retention.CheckInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if l.raft.State() != raft.Leader {
+				continue
+			}
+			l.truncateExpired(now, partitionID{}, l.log, l.config)
+			for _, topic := range l.topics.List() {
+				c := retentionConfig(l.config, topic.Config)
+				for p := uint32(0); p < partitionCount(topic.Config); p++ {
+					log, err := l.topics.Get(topic.Name, p)
+					if err != nil {
+						break
+					}
+					l.truncateExpired(now, partitionID{topic.Name, p}, log, c)
+				}
+			}
+		}
+	}
+}
+
+func (l *DistributedLog) truncateExpired(now time.Time, id partitionID, log *Log, c Config) {
+	lowest, ok := log.expiredOffset(now, c)
+	if !ok {
+		return
+	}
+	if _, err := l.apply(
+		TruncateRequestType,
+		&TruncateRequest{
+			Lowest:    lowest,
+			Topic:     id.topic,
+			Partition: id.partition,
+		},
+	); err != nil {
+		zap.L().Named("log").Error(
+			"failed to enforce retention",
+			zap.Error(err),
+			zap.String("topic", id.topic),
+			zap.Uint32("partition", id.partition),
+			zap.Uint64("lowest", lowest),
+		)
+	}
+}
+
+// compactPeriodically has the leader compact every log that the node or its
+// topic configures compaction for. The leader picks the horizon and the time
+// tombstones age from, so that every replica drops the same records.
+func (l *DistributedLog) compactPeriodically(done <-chan struct{}) {
+	defer l.wg.Done()
+
+	interval := l.config.Compaction.CheckInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if l.raft.State() != raft.Leader {
+				continue
+			}
+			l.compactLog(now, partitionID{}, l.log, l.config.Compaction.Enabled)
+			for _, topic := range l.topics.List() {
+				compacted := l.config.Compaction.Enabled || topic.Config.Compaction
+				for p := uint32(0); p < partitionCount(topic.Config); p++ {
+					log, err := l.topics.Get(topic.Name, p)
+					if err != nil {
+						break
+					}
+					l.compactLog(now, partitionID{topic.Name, p}, log, compacted)
+				}
+			}
+		}
+	}
+}
+
+// compactLog compacts log through Raft, or only compresses its closed
+// segments if it isn't compacted.
+func (l *DistributedLog) compactLog(now time.Time, id partitionID, log *Log, compacted bool) {
+	horizon, ok := log.compactionHorizon()
+	if !ok {
+		return
+	}
+	if !compacted {
+		if !log.uncompressed() {
+			return
+		}
+		horizon = 0
+	}
+	if _, err := l.apply(
+		CompactRequestType,
+		&CompactRequest{
+			Topic:          id.topic,
+			Partition:      id.partition,
+			Horizon:        horizon,
+			Now:            now.UnixNano(),
+			TombstoneGrace: int64(l.config.Compaction.TombstoneGrace),
+		},
+	); err != nil {
+		zap.L().Named("log").Error(
+			"failed to compact log",
+			zap.Error(err),
+			zap.String("topic", id.topic),
+			zap.Uint32("partition", id.partition),
+			zap.Uint64("horizon", horizon),
+		)
+	}
 }
 
 func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
@@ -186,6 +667,16 @@ func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
 	return l.log.Read(offset)
 }
 
+func (l *DistributedLog) ReadBatch(off uint64, maxRecords int, maxBytes uint64) (
+	[]*api.Record, error,
+) {
+	return l.log.ReadBatch(off, maxRecords, maxBytes)
+}
+
+func (l *DistributedLog) OffsetForTime(t time.Time) (uint64, error) {
+	return l.log.OffsetForTime(t)
+}
+
 func (l *DistributedLog) Join(id, addr string) error {
 	configFuture := l.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
@@ -235,6 +726,13 @@ func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
 }
 
 func (l *DistributedLog) Close() error {
+	l.mu.Lock()
+	if l.done != nil {
+		close(l.done)
+		l.done = nil
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
 	f := l.raft.Shutdown()
 	if err := f.Error(); err != nil {
 		return err
@@ -242,35 +740,153 @@ func (l *DistributedLog) Close() error {
 	if err := l.raftLog.Log.Close(); err != nil {
 		return err
 	}
+	if err := l.topics.Close(); err != nil {
+		return err
+	}
 	return l.log.Close()
 }
 
+// Leader returns the ID and RPC address of the current leader, empty if
+// there is none, and whether this node is the leader.
+func (l *DistributedLog) Leader() (string, string, bool) {
+	addr, id := l.raft.LeaderWithID()
+	return string(id), string(addr), l.raft.State() == raft.Leader
+}
+
 func (l *DistributedLog) GetServers() ([]*api.Server, error) {
 	future := l.raft.GetConfiguration()
 	if err := future.Error(); err != nil {
 		return nil, err
 	}
+	// Every server replicates every topic in the same Raft cluster.
+	partitions := make(map[string]uint32)
+	for _, topic := range l.topics.List() {
+		partitions[topic.Name] = partitionCount(topic.Config)
+	}
 	var servers []*api.Server
 	for _, server := range future.Configuration().Servers {
 		servers = append(servers, &api.Server{
-			Id:       string(server.ID),
-			RpcAddr:  string(server.Address),
-			IsLeader: l.raft.Leader() == server.Address,
+			Id:         string(server.ID),
+			RpcAddr:    string(server.Address),
+			IsLeader:   l.raft.Leader() == server.Address,
+			Partitions: partitions,
 		})
 	}
 	return servers, nil
 }
 
+// Info describes this node's log together with its view of Raft.
+func (l *DistributedLog) Info() (*api.LogInfo, error) {
+	return l.info(l.log)
+}
+
+func (l *DistributedLog) info(log *Log) (*api.LogInfo, error) {
+	info, err := log.Info()
+	if err != nil {
+		return nil, err
+	}
+	info.CommitIndex, err = strconv.ParseUint(l.raft.Stats()["commit_index"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	info.AppliedIndex = l.raft.AppliedIndex()
+	info.IsLeader = l.raft.State() == raft.Leader
+	return info, nil
+}
+
+// Snapshot takes a snapshot of this node, letting Raft drop the log
+// entries it covers, and describes the latest snapshot. Nothing is taken if
+// nothing was applied since the last one.
+func (l *DistributedLog) Snapshot() (*api.SnapshotInfo, error) {
+	info, err := l.lastSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if info != nil && info.Index >= l.raft.AppliedIndex() {
+		return info, nil
+	}
+	err = l.raft.Snapshot().Error()
+	if err != nil && !errors.Is(err, raft.ErrNothingNewToSnapshot) {
+		return nil, err
+	}
+	return l.lastSnapshot()
+}
+
+// lastSnapshot describes the latest snapshot, nil if there is none.
+func (l *DistributedLog) lastSnapshot() (*api.SnapshotInfo, error) {
+	metas, err := l.snapshots.List()
+	if err != nil || len(metas) == 0 {
+		return nil, err
+	}
+	meta, r, err := l.snapshots.Open(metas[0].ID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	state, err := readSnapshotState(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	info := &api.SnapshotInfo{
+		Id:        meta.ID,
+		Index:     meta.Index,
+		Term:      meta.Term,
+		SizeBytes: uint64(meta.Size),
+	}
+	if m := state.Manifest; m != nil {
+		info.TakenAt = m.TakenAt
+		for _, lm := range m.Logs {
+			for _, seg := range lm.Segments {
+				info.SegmentBytes += seg.StoreBytes + seg.IndexBytes
+			}
+		}
+	}
+	return info, nil
+}
+
 var _ raft.FSM = (*fsm)(nil)
 
 type fsm struct {
-	log *Log
+	log    *Log
+	topics *Topics
+
+	mu             sync.RWMutex
+	offsets        map[string]uint64
+	producers      map[uint64]*producerState
+	nextProducerID uint64
+
+	// keys holds the offset of the latest record of each key, built from
+	// the log the first time a conditional append needs it.
+	keys map[partitionID]map[string]uint64
+
+	// segments is where snapshots pin their segments; followers fetch them
+	// from the node at addr with dial.
+	segments string
+	addr     string
+	dial     func(addr string) (net.Conn, error)
+
+	// changed is called after the topics changed.
+	changed func()
+}
+
+// partitionID identifies a partition of a topic. The default log is the
+// partition 0 of the empty topic.
+type partitionID struct {
+	topic     string
+	partition uint32
 }
 
 type RequestType uint8
 
 const (
-	AppendRequestType RequestType = 0
+	AppendRequestType           RequestType = 0
+	TruncateRequestType         RequestType = 1
+	AppendBatchRequestType      RequestType = 2
+	CommitOffsetRequestType     RequestType = 3
+	RegisterProducerRequestType RequestType = 4
+	CreateTopicRequestType      RequestType = 5
+	DeleteTopicRequestType      RequestType = 6
+	CompactRequestType          RequestType = 7
 )
 
 func (f *fsm) Apply(record *raft.Log) any {
@@ -278,27 +894,356 @@ func (f *fsm) Apply(record *raft.Log) any {
 	reqType := RequestType(buf[0])
 	switch reqType {
 	case AppendRequestType:
-		return f.applyAppend(buf[1:])
+		return f.applyAppend(buf[1:], record.Index)
+	case TruncateRequestType:
+		return f.applyTruncate(buf[1:])
+	case AppendBatchRequestType:
+		return f.applyAppendBatch(buf[1:])
+	case CommitOffsetRequestType:
+		return f.applyCommitOffset(buf[1:])
+	case RegisterProducerRequestType:
+		return f.applyRegisterProducer(buf[1:], record.Index)
+	case CreateTopicRequestType:
+		return f.applyCreateTopic(buf[1:])
+	case DeleteTopicRequestType:
+		return f.applyDeleteTopic(buf[1:])
+	case CompactRequestType:
+		return f.applyCompact(buf[1:])
 	}
 	return nil
 }
 
-func (f *fsm) applyAppend(b []byte) any {
+func (f *fsm) applyAppend(b []byte, index uint64) any {
 	var req api.ProduceRequest
 	err := proto.Unmarshal(b, &req)
 	if err != nil {
 		return err
 	}
-	offset, err := f.log.Append(req.Record)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var p *producerState
+	if req.ProducerId != 0 {
+		var ok bool
+		p, ok = f.producers[req.ProducerId]
+		if !ok {
+			return api.ErrUnknownProducer{ProducerID: req.ProducerId}
+		}
+		p.lastIndex = index
+		r, ok, err := p.appended(req.Sequence)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return &api.ProduceResponse{
+				Offset:    r.Offset,
+				Partition: r.Partition,
+			}
+		}
+	}
+	id := partitionID{req.Topic, req.GetPartition()}
+	log, err := f.partitionLog(id)
+	if err != nil {
+		return err
+	}
+	if err := f.checkConditions(id, log, &req); err != nil {
+		return err
+	}
+	offset, err := log.Append(req.Record)
 	if err != nil {
 		return err
 	}
-	return &api.ProduceResponse{Offset: offset}
+	f.indexKeys(id, req.Record)
+	if p != nil {
+		p.append(&api.SequencedOffset{
+			Sequence:  req.Sequence,
+			Offset:    offset,
+			Partition: id.partition,
+		})
+	}
+	return &api.ProduceResponse{Offset: offset, Partition: id.partition}
+}
+
+// partitionLog returns the log of a partition.
+func (f *fsm) partitionLog(id partitionID) (*Log, error) {
+	if id.topic != "" {
+		return f.topics.Get(id.topic, id.partition)
+	}
+	if id.partition != 0 {
+		return nil, api.ErrPartitionNotFound{Partition: id.partition}
+	}
+	return f.log, nil
+}
+
+// checkConditions returns ErrConditionFailed unless the expected offsets
+// of req hold. Every replica evaluates them against the same log, so they
+// all come to the same result.
+func (f *fsm) checkConditions(id partitionID, log *Log, req *api.ProduceRequest) error {
+	if req.ExpectedLastOffset != nil {
+		last := log.lastOffset()
+		if last != *req.ExpectedLastOffset {
+			return api.ErrConditionFailed{
+				Expected: *req.ExpectedLastOffset,
+				Actual:   last,
+			}
+		}
+	}
+	if req.ExpectedKeyOffset != nil {
+		keys, ok := f.keys[id]
+		if !ok {
+			var err error
+			keys, err = log.latestOffsets()
+			if err != nil {
+				return err
+			}
+			f.keys[id] = keys
+		}
+		actual := int64(-1)
+		if off, ok := keys[string(req.Record.Key)]; ok {
+			actual = int64(off)
+		}
+		if actual != *req.ExpectedKeyOffset {
+			return api.ErrConditionFailed{
+				Key:      req.Record.Key,
+				Expected: *req.ExpectedKeyOffset,
+				Actual:   actual,
+			}
+		}
+	}
+	return nil
+}
+
+// indexKeys keeps keys up to date with records appended to a partition.
+func (f *fsm) indexKeys(id partitionID, records ...*api.Record) {
+	keys, ok := f.keys[id]
+	if !ok {
+		return
+	}
+	for _, record := range records {
+		if len(record.Key) != 0 {
+			keys[string(record.Key)] = record.Offset
+		}
+	}
 }
 
+func (f *fsm) applyRegisterProducer(b []byte, index uint64) any {
+	var req RegisterProducerRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if req.Expiry != 0 {
+		for id, p := range f.producers {
+			if p.lastIndex+req.Expiry < index {
+				delete(f.producers, id)
+			}
+		}
+	}
+	// ID 0 means a producer isn't idempotent.
+	f.nextProducerID++
+	id := f.nextProducerID
+	f.producers[id] = &producerState{id: id, lastIndex: index}
+	return &api.RegisterProducerResponse{ProducerId: id}
+}
+
+func (f *fsm) applyAppendBatch(b []byte) any {
+	var req api.ProduceBatchRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := partitionID{req.Topic, req.GetPartition()}
+	log, err := f.partitionLog(id)
+	if err != nil {
+		return err
+	}
+	first, err := log.AppendBatch(req.Records)
+	if err != nil {
+		return err
+	}
+	f.indexKeys(id, req.Records...)
+	return &api.ProduceBatchResponse{
+		FirstOffset: first,
+		LastOffset:  first + uint64(len(req.Records)) - 1,
+		Partition:   id.partition,
+	}
+}
+
+func (f *fsm) applyTruncate(b []byte) any {
+	var req TruncateRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := partitionID{req.Topic, req.Partition}
+	log, err := f.partitionLog(id)
+	if err != nil {
+		return err
+	}
+	delete(f.keys, id)
+	return log.Truncate(req.Lowest)
+}
+
+func (f *fsm) applyCompact(b []byte) any {
+	var req CompactRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := partitionID{req.Topic, req.Partition}
+	log, err := f.partitionLog(id)
+	if err != nil {
+		return err
+	}
+	delete(f.keys, id)
+	return log.compact(
+		req.Horizon,
+		time.Unix(0, req.Now),
+		time.Duration(req.TombstoneGrace),
+	)
+}
+
+func (f *fsm) applyCreateTopic(b []byte) any {
+	var req api.CreateTopicRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	if err := f.topics.Create(req.Topic.GetName(), req.Topic.GetConfig()); err != nil {
+		return err
+	}
+	f.topicsChanged()
+	return nil
+}
+
+func (f *fsm) topicsChanged() {
+	if f.changed != nil {
+		f.changed()
+	}
+}
+
+func (f *fsm) applyDeleteTopic(b []byte) any {
+	var req api.DeleteTopicRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id := range f.keys {
+		if id.topic == req.Name {
+			delete(f.keys, id)
+		}
+	}
+	return f.topics.Delete(req.Name)
+}
+
+func (f *fsm) applyCommitOffset(b []byte) any {
+	var req api.CommitOffsetRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.offsets[req.Group] = req.Offset
+	return nil
+}
+
+func (f *fsm) offset(group string) (uint64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	off, ok := f.offsets[group]
+	if !ok {
+		return 0, api.ErrNoCommittedOffset{Group: group}
+	}
+	return off, nil
+}
+
+func (f *fsm) state() *api.FSMState {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	state := &api.FSMState{
+		NextProducerId: f.nextProducerID,
+		Topics:         f.topics.List(),
+	}
+	for group, off := range f.offsets {
+		state.GroupOffsets = append(state.GroupOffsets, &api.GroupOffset{
+			Group:  group,
+			Offset: off,
+		})
+	}
+	for id, p := range f.producers {
+		state.Producers = append(state.Producers, &api.ProducerState{
+			ProducerId: id,
+			Recent:     p.recent,
+			LastIndex:  p.lastIndex,
+		})
+	}
+	return state
+}
+
+func (f *fsm) setState(state *api.FSMState) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.offsets = make(map[string]uint64, len(state.GroupOffsets))
+	for _, g := range state.GroupOffsets {
+		f.offsets[g.Group] = g.Offset
+	}
+	f.producers = make(map[uint64]*producerState, len(state.Producers))
+	for _, p := range state.Producers {
+		f.producers[p.ProducerId] = &producerState{
+			id:        p.ProducerId,
+			recent:    p.Recent,
+			lastIndex: p.LastIndex,
+		}
+	}
+	f.nextProducerID = state.NextProducerId
+	f.keys = make(map[partitionID]map[string]uint64)
+}
+
+// snapshotMagic starts a snapshot that carries the FSM state ahead of the
+// records. Read as the length prefix of a record in a snapshot taken before
+// state was saved, it would announce a record of maxRecordLen bytes, which
+// no record replicated through Raft comes close to.
+const snapshotMagic uint64 = 1<<64 - 1
+
+// snapshotSection returns a section header of a snapshot: snapshotMagic
+// followed by the length-prefixed p. The first section holds the FSM state.
+// Snapshots taken before segments were pinned go on with the records of the
+// default log and sections naming the partition whose records follow, as
+// topic/partition.
+func snapshotSection(p []byte) []byte {
+	b := make([]byte, 2*lenWidth, 2*lenWidth+len(p))
+	enc.PutUint64(b, snapshotMagic)
+	enc.PutUint64(b[lenWidth:], encodeLen(p))
+	return append(b, p...)
+}
+
+// Snapshot pins the segments of every log and saves their manifest with
+// the FSM state, leaving the records where they are.
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
-	r := f.log.Reader()
-	return &snapshot{reader: r}, nil
+	state := f.state()
+	now := time.Now().UnixNano()
+	manifest, err := f.pin(strconv.FormatInt(now, 10), state.Topics)
+	if err != nil {
+		return nil, err
+	}
+	manifest.TakenAt = now
+	state.Manifest = manifest
+	b, err := proto.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{reader: bytes.NewReader(snapshotSection(b))}, nil
 }
 
 var _ raft.FSMSnapshot = (*snapshot)(nil)
@@ -318,31 +1263,59 @@ func (s *snapshot) Persist(sink raft.SnapshotSink) error {
 func (s *snapshot) Release() {}
 
 func (f *fsm) Restore(r io.ReadCloser) error {
+	br := bufio.NewReader(r)
 	b := make([]byte, lenWidth)
 	var buf bytes.Buffer
+	state, err := readSnapshotState(br)
+	if err != nil {
+		return err
+	}
+	f.setState(state)
+	if state.Manifest != nil {
+		if err := f.topics.replace(state.Topics); err != nil {
+			return err
+		}
+		f.topicsChanged()
+		return f.install(state.Manifest)
+	}
+	if err := f.topics.Reset(state.Topics); err != nil {
+		return err
+	}
+	f.topicsChanged()
+	log, first := f.log, true
 	for i := 0; ; i++ {
-		_, err := io.ReadFull(r, b)
+		section, err := readSnapshotEntry(br, b, &buf)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			return fmt.Errorf("snapshot record %d: %w", i, err)
 		}
-		size := int64(enc.Uint64(b))
-		if _, err := io.CopyN(&buf, r, size); err != nil {
-			return err
+		if section {
+			id, err := parseSection(buf.String())
+			if err != nil {
+				return err
+			}
+			if log, err = f.topics.Get(id.topic, id.partition); err != nil {
+				return err
+			}
+			first = true
+			buf.Reset()
+			continue
 		}
 		record := &api.Record{}
 		if err := proto.Unmarshal(buf.Bytes(), record); err != nil {
 			return err
 		}
-		if i == 0 {
-			f.log.Config.Segment.InitialOffset = record.Offset
-			if err := f.log.Reset(); err != nil {
+		if first {
+			log.Config.Segment.InitialOffset = record.Offset
+			if err := log.Reset(); err != nil {
 				return err
 			}
+			first = false
 		}
-		if _, err := f.log.Append(record); err != nil {
+		// Keep the offsets compaction left gaps between.
+		if err := log.write(record); err != nil {
 			return err
 		}
 		buf.Reset()
@@ -350,6 +1323,61 @@ func (f *fsm) Restore(r io.ReadCloser) error {
 	return nil
 }
 
+// readSnapshotState reads the FSM state at the head of a snapshot, leaving
+// r at the records that follow in older snapshots.
+func readSnapshotState(r *bufio.Reader) (*api.FSMState, error) {
+	state := &api.FSMState{}
+	hdr, err := r.Peek(lenWidth)
+	if err != nil || enc.Uint64(hdr) != snapshotMagic {
+		return state, nil
+	}
+	var buf bytes.Buffer
+	if _, err := readSnapshotEntry(r, make([]byte, lenWidth), &buf); err != nil {
+		return nil, fmt.Errorf("snapshot state: %w", err)
+	}
+	if err := proto.Unmarshal(buf.Bytes(), state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// parseSection returns the partition a section header of a snapshot names.
+// Snapshots taken before topics had partitions name only the topic.
+func parseSection(section string) (partitionID, error) {
+	name, p, ok := strings.Cut(section, "/")
+	if !ok {
+		return partitionID{topic: name}, nil
+	}
+	partition, err := strconv.ParseUint(p, 10, 32)
+	if err != nil {
+		return partitionID{}, err
+	}
+	return partitionID{name, uint32(partition)}, nil
+}
+
+// readSnapshotEntry reads a length-prefixed entry of a snapshot into buf,
+// reporting whether it is the payload of a section header. It returns
+// io.EOF at the end of the snapshot.
+func readSnapshotEntry(r io.Reader, b []byte, buf *bytes.Buffer) (bool, error) {
+	if _, err := io.ReadFull(r, b); err != nil {
+		return false, err
+	}
+	section := enc.Uint64(b) == snapshotMagic
+	if section {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return false, err
+		}
+	}
+	size, sum, checked := decodeLen(enc.Uint64(b))
+	if _, err := io.CopyN(buf, r, int64(size)); err != nil {
+		return false, err
+	}
+	if !validRecord(buf.Bytes(), sum, checked) {
+		return false, fmt.Errorf("checksum mismatch")
+	}
+	return section, nil
+}
+
 var _ raft.LogStore = (*logStore)(nil)
 
 type logStore struct {
@@ -364,18 +1392,41 @@ func newLogSotre(dir string, c Config) (*logStore, error) {
 	return &logStore{log}, nil
 }
 
+// FirstIndex returns the index of the first entry, 0 if there is none.
 func (l *logStore) FirstIndex() (uint64, error) {
-	return l.LowestOffset()
+	if l.lastOffset() < 0 {
+		return 0, nil
+	}
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return 0, err
+	}
+	// Entries stored after everything was deleted don't start at the
+	// base offset of their segment.
+	records, err := l.ReadBatch(lowest, 1, 0)
+	if err != nil {
+		return 0, err
+	}
+	return records[0].Offset, nil
 }
 
+// LastIndex returns the index of the last entry, 0 if there is none.
 func (l *logStore) LastIndex() (uint64, error) {
-	off, err := l.HighestOffset()
-	return off, err
+	last := l.lastOffset()
+	if last < 0 {
+		return 0, nil
+	}
+	return uint64(last), nil
 }
 
 func (l *logStore) GetLog(index uint64, out *raft.Log) error {
 	in, err := l.Read(index)
-	if err != nil {
+	switch err.(type) {
+	case nil:
+	case api.ErrOffsetOutOfRange, api.ErrOffsetCompacted:
+		// Raft sends a snapshot to followers missing the entry.
+		return raft.ErrLogNotFound
+	default:
 		return err
 	}
 	out.Data = in.Value
@@ -389,22 +1440,30 @@ func (l *logStore) StoreLog(record *raft.Log) error {
 	return l.StoreLogs([]*raft.Log{record})
 }
 
+// StoreLogs writes each entry at its index and returns once the batch is on
+// disk, as Raft acknowledges entries as soon as they are stored. An index
+// below the next one fails rather than being written out of place;
+// conflicting entries have to be removed with DeleteRange first.
 func (l *logStore) StoreLogs(records []*raft.Log) error {
-	for _, record := range records {
-		if _, err := l.Append(
-			&api.Record{
-				Value: record.Data,
-				Term:  record.Term,
-				Type:  uint32(record.Type),
-			},
-		); err != nil {
-			return err
+	batch := make([]*api.Record, len(records))
+	for i, record := range records {
+		batch[i] = &api.Record{
+			Value:  record.Data,
+			Term:   record.Term,
+			Type:   uint32(record.Type),
+			Offset: record.Index,
 		}
 	}
-	return nil
+	return l.writeBatch(batch)
 }
 
+// DeleteRange removes the entries from min to max. Raft deletes either a
+// prefix covered by a snapshot or, after a leader change, a conflicting
+// suffix that it rewrites next.
 func (l *logStore) DeleteRange(min, max uint64) error {
+	if last := l.lastOffset(); last >= 0 && max >= uint64(last) {
+		return l.TruncateSuffix(min)
+	}
 	return l.Truncate(max)
 }
 
@@ -414,6 +1473,8 @@ type StreamLayer struct {
 	ln              net.Listener
 	serverTLSConfig *tls.Config
 	peerTLSConfig   *tls.Config
+	// segments serves the connections fetching segments of snapshots.
+	segments func(net.Conn)
 }
 
 func NewStreamLayer(
@@ -428,18 +1489,30 @@ func NewStreamLayer(
 	}
 }
 
-const RaftRPC = 1
+const (
+	RaftRPC = 1
+	// SegmentRPC starts a connection fetching a segment of a snapshot.
+	SegmentRPC = 2
+)
 
 func (s *StreamLayer) Dial(
 	addr raft.ServerAddress,
 	timeout time.Duration,
+) (net.Conn, error) {
+	return s.dial(string(addr), RaftRPC, timeout)
+}
+
+func (s *StreamLayer) dial(
+	addr string,
+	rpc byte,
+	timeout time.Duration,
 ) (net.Conn, error) {
 	dialer := &net.Dialer{Timeout: timeout}
-	conn, err := dialer.Dial("tcp", string(addr))
+	conn, err := dialer.Dial("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
-	_, err = conn.Write([]byte{byte(RaftRPC)})
+	_, err = conn.Write([]byte{rpc})
 	if err != nil {
 		return nil, err
 	}
@@ -449,23 +1522,32 @@ func (s *StreamLayer) Dial(
 	return conn, nil
 }
 
+// Accept returns the next Raft connection. Connections fetching segments
+// are handed to the segment server instead.
 func (s *StreamLayer) Accept() (net.Conn, error) {
-	conn, err := s.ln.Accept()
-	if err != nil {
-		return nil, err
-	}
-	b := make([]byte, 1)
-	_, err = conn.Read(b)
-	if err != nil {
-		return nil, err
-	}
-	if !bytes.Equal([]byte{byte(RaftRPC)}, b) {
-		return nil, fmt.Errorf("not a raft rpc")
-	}
-	if s.serverTLSConfig != nil {
-		conn = tls.Server(conn, s.serverTLSConfig)
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, 1)
+		_, err = conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		if s.serverTLSConfig != nil {
+			conn = tls.Server(conn, s.serverTLSConfig)
+		}
+		if bytes.Equal([]byte{byte(SegmentRPC)}, b) && s.segments != nil {
+			go s.segments(conn)
+			continue
+		}
+		if !bytes.Equal([]byte{byte(RaftRPC)}, b) {
+			conn.Close()
+			return nil, fmt.Errorf("not a raft rpc")
+		}
+		return conn, nil
 	}
-	return conn, nil
 }
 
 func (s *StreamLayer) Close() error {
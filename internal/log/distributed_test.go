@@ -1,6 +1,7 @@
 package log_test
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
@@ -118,3 +119,651 @@ func TestMultipleNodes(t *testing.T) {
 	require.Equal(t, []byte("third"), record.Value)
 	require.Equal(t, off, record.Offset)
 }
+
+func setupCluster(t *testing.T, nodeCount int, fn func(*log.Config)) []*log.DistributedLog {
+	t.Helper()
+
+	var logs []*log.DistributedLog
+	ports := dynaport.Get(nodeCount)
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := os.MkdirTemp("", "distributed-log-test")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = os.RemoveAll(dataDir)
+		})
+
+		ln, err := net.Listen(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", ports[i]),
+		)
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 100 * time.Millisecond
+		config.Raft.ElectionTimeout = 100 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 100 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		if i == 0 {
+			config.Raft.BootStrap = true
+		}
+		if fn != nil {
+			fn(&config)
+		}
+
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = l.Close()
+		})
+
+		if i != 0 {
+			err = logs[0].Join(
+				fmt.Sprintf("%d", i), ln.Addr().String(),
+			)
+			require.NoError(t, err)
+		} else {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+		logs = append(logs, l)
+	}
+	return logs
+}
+
+func TestRetention(t *testing.T) {
+	logs := setupCluster(t, 3, func(c *log.Config) {
+		c.Segment.MaxIndexBytes = 36
+		c.Retention.MaxBytes = 120
+		c.Retention.CheckInterval = 50 * time.Millisecond
+	})
+
+	for i := 0; i < 7; i++ {
+		_, err := logs[0].Append(&api.Record{Value: []byte("test")})
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		for _, l := range logs {
+			if _, err := l.Read(2); err == nil {
+				return false
+			}
+			if _, err := l.Read(3); err != nil {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestCompaction(t *testing.T) {
+	logs := setupCluster(t, 3, func(c *log.Config) {
+		c.Segment.MaxIndexBytes = 36
+		c.Compaction.Enabled = true
+		c.Compaction.CheckInterval = 50 * time.Millisecond
+	})
+
+	for _, kv := range [][2]string{
+		{"a", "1"}, {"b", "1"}, {"a", "2"},
+		{"c", "1"}, {"b", ""}, {"", "no key"},
+		{"a", "3"},
+	} {
+		_, err := logs[0].Append(&api.Record{
+			Key:   []byte(kv[0]),
+			Value: []byte(kv[1]),
+		})
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		for _, l := range logs {
+			for _, off := range []uint64{0, 1, 2, 4} {
+				_, err := l.Read(off)
+				if err != (api.ErrOffsetCompacted{Offset: off}) {
+					return false
+				}
+			}
+			for _, off := range []uint64{3, 5, 6} {
+				if _, err := l.Read(off); err != nil {
+					return false
+				}
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestAppendBatch(t *testing.T) {
+	logs := setupCluster(t, 3, nil)
+
+	records := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+		{Value: []byte("third")},
+	}
+	first, err := logs[0].AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), first)
+
+	require.Eventually(t, func() bool {
+		for _, l := range logs {
+			for i, record := range records {
+				got, err := l.Read(first + uint64(i))
+				if err != nil || !reflect.DeepEqual(got.Value, record.Value) {
+					return false
+				}
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	info, err := logs[0].Info()
+	require.NoError(t, err)
+	require.True(t, info.IsLeader)
+	require.Equal(t, uint64(2), info.HighestOffset)
+	require.NotZero(t, info.CommitIndex)
+	info, err = logs[1].Info()
+	require.NoError(t, err)
+	require.False(t, info.IsLeader)
+	require.Equal(t, uint64(2), info.HighestOffset)
+}
+
+func TestReadBarrier(t *testing.T) {
+	logs := setupCluster(t, 2, nil)
+
+	_, err := logs[0].Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+
+	type args struct {
+		log         *log.DistributedLog
+		consistency api.ReadConsistency
+		minOffset   uint64
+	}
+	tests := []struct {
+		name      string
+		args      args
+		setup     func()
+		assertion require.ErrorAssertionFunc
+	}{
+		{
+			name: "ok case any on follower",
+			args: args{
+				log:         logs[1],
+				consistency: api.ReadConsistency_READ_ANY,
+			},
+			setup:     func() {},
+			assertion: require.NoError,
+		},
+		{
+			name: "ok case linearizable on leader",
+			args: args{
+				log:         logs[0],
+				consistency: api.ReadConsistency_READ_LINEARIZABLE,
+			},
+			setup:     func() {},
+			assertion: require.NoError,
+		},
+		{
+			name: "error case linearizable on follower",
+			args: args{
+				log:         logs[1],
+				consistency: api.ReadConsistency_READ_LINEARIZABLE,
+			},
+			setup: func() {},
+			assertion: func(tt require.TestingT, err error, i ...interface{}) {
+				require.ErrorIs(tt, err, raft.ErrNotLeader)
+			},
+		},
+		{
+			name: "ok case at least offset on follower",
+			args: args{
+				log:         logs[1],
+				consistency: api.ReadConsistency_READ_AT_LEAST_OFFSET,
+				minOffset:   1,
+			},
+			setup: func() {
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					logs[0].Append(&api.Record{Value: []byte("second")})
+				}()
+			},
+			assertion: require.NoError,
+		},
+		{
+			name: "error case at least offset never applied",
+			args: args{
+				log:         logs[1],
+				consistency: api.ReadConsistency_READ_AT_LEAST_OFFSET,
+				minOffset:   10,
+			},
+			setup: func() {},
+			assertion: func(tt require.TestingT, err error, i ...interface{}) {
+				require.ErrorIs(tt, err, context.DeadlineExceeded)
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			tt.setup()
+			err := tt.args.log.ReadBarrier(ctx, tt.args.consistency, tt.args.minOffset)
+			tt.assertion(t, err)
+		})
+	}
+}
+
+func TestCommitOffset(t *testing.T) {
+	logs := setupCluster(t, 3, nil)
+
+	_, err := logs[0].FetchOffset("orders")
+	require.Equal(t, api.ErrNoCommittedOffset{Group: "orders"}, err)
+
+	require.NoError(t, logs[0].CommitOffset("orders", 3))
+	require.NoError(t, logs[0].CommitOffset("orders", 5))
+	require.NoError(t, logs[0].CommitOffset("billing", 1))
+
+	require.Eventually(t, func() bool {
+		for _, l := range logs {
+			orders, err := l.FetchOffset("orders")
+			if err != nil || orders != 5 {
+				return false
+			}
+			billing, err := l.FetchOffset("billing")
+			if err != nil || billing != 1 {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	err = logs[1].CommitOffset("orders", 6)
+	require.ErrorIs(t, err, raft.ErrNotLeader)
+}
+
+func TestAppendRequestSequenced(t *testing.T) {
+	logs := setupCluster(t, 2, nil)
+	appendSequenced := func(value string, id, seq uint64) (uint64, error) {
+		res, err := logs[0].AppendRequest(&api.ProduceRequest{
+			Record:     &api.Record{Value: []byte(value)},
+			ProducerId: id,
+			Sequence:   seq,
+		})
+		if err != nil {
+			return 0, err
+		}
+		return res.Offset, nil
+	}
+
+	_, err := appendSequenced("first", 1, 1)
+	require.Equal(t, api.ErrUnknownProducer{ProducerID: 1}, err)
+
+	id, err := logs[0].RegisterProducer()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), id)
+
+	var offsets []uint64
+	for seq := uint64(1); seq <= 7; seq++ {
+		off, err := appendSequenced(fmt.Sprintf("record %d", seq), id, seq)
+		require.NoError(t, err)
+		offsets = append(offsets, off)
+	}
+
+	tests := []struct {
+		name string
+		seq  uint64
+		off  uint64
+		err  error
+	}{
+		{
+			name: "ok case latest resent",
+			seq:  7,
+			off:  offsets[6],
+		},
+		{
+			name: "ok case earlier resent",
+			seq:  3,
+			off:  offsets[2],
+		},
+		{
+			name: "ng case too old",
+			seq:  2,
+			err:  api.ErrStaleSequence{ProducerID: id, Sequence: 2, Last: 7},
+		},
+		{
+			name: "ng case gap",
+			seq:  9,
+			err:  api.ErrSequenceGap{ProducerID: id, Sequence: 9, Last: 7},
+		},
+	}
+	for _, tt := range tests {
+		off, err := appendSequenced("resent", id, tt.seq)
+		require.Equal(t, tt.err, err, tt.name)
+		require.Equal(t, tt.off, off, tt.name)
+	}
+
+	off, err := appendSequenced("next", id, 8)
+	require.NoError(t, err)
+	require.Equal(t, offsets[6]+1, off)
+
+	require.Eventually(t, func() bool {
+		_, err := logs[1].Read(off)
+		return err == nil
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	_, err = logs[1].Read(off + 1)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+func TestProducerExpiry(t *testing.T) {
+	logs := setupCluster(t, 2, func(c *log.Config) {
+		c.ProducerExpiry = 3
+	})
+
+	idle, err := logs[0].RegisterProducer()
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := logs[0].Append(&api.Record{Value: []byte("test")})
+		require.NoError(t, err)
+	}
+	active, err := logs[0].RegisterProducer()
+	require.NoError(t, err)
+
+	_, err = logs[0].AppendRequest(&api.ProduceRequest{
+		Record:     &api.Record{Value: []byte("idle")},
+		ProducerId: idle,
+		Sequence:   1,
+	})
+	require.Equal(t, api.ErrUnknownProducer{ProducerID: idle}, err)
+	_, err = logs[0].AppendRequest(&api.ProduceRequest{
+		Record:     &api.Record{Value: []byte("active")},
+		ProducerId: active,
+		Sequence:   1,
+	})
+	require.NoError(t, err)
+}
+
+func TestAppendRequestConditional(t *testing.T) {
+	logs := setupCluster(t, 2, nil)
+	offset := func(off int64) *int64 { return &off }
+
+	tests := []struct {
+		name    string
+		key     string
+		last    *int64
+		keyLast *int64
+		off     uint64
+		err     error
+	}{
+		{
+			name: "ok case empty log",
+			key:  "a",
+			last: offset(-1),
+			off:  0,
+		},
+		{
+			name: "ng case stale last offset",
+			last: offset(-1),
+			err:  api.ErrConditionFailed{Expected: -1, Actual: 0},
+		},
+		{
+			name:    "ok case new key",
+			key:     "b",
+			last:    offset(0),
+			keyLast: offset(-1),
+			off:     1,
+		},
+		{
+			name:    "ok case latest of key",
+			key:     "a",
+			keyLast: offset(0),
+			off:     2,
+		},
+		{
+			name:    "ng case stale key offset",
+			key:     "a",
+			keyLast: offset(0),
+			err: api.ErrConditionFailed{
+				Key:      []byte("a"),
+				Expected: 0,
+				Actual:   2,
+			},
+		},
+		{
+			name: "ok case unconditional",
+			key:  "b",
+			off:  3,
+		},
+		{
+			name:    "ok case key moved by unconditional append",
+			key:     "b",
+			last:    offset(3),
+			keyLast: offset(3),
+			off:     4,
+		},
+	}
+	for _, tt := range tests {
+		record := &api.Record{Value: []byte(tt.name)}
+		if tt.key != "" {
+			record.Key = []byte(tt.key)
+		}
+		res, err := logs[0].AppendRequest(&api.ProduceRequest{
+			Record:             record,
+			ExpectedLastOffset: tt.last,
+			ExpectedKeyOffset:  tt.keyLast,
+		})
+		require.Equal(t, tt.err, err, tt.name)
+		require.Equal(t, tt.off, res.GetOffset(), tt.name)
+	}
+
+	require.Eventually(t, func() bool {
+		_, err := logs[1].Read(4)
+		return err == nil
+	}, 500*time.Millisecond, 50*time.Millisecond)
+}
+
+func TestTopicRetention(t *testing.T) {
+	logs := setupCluster(t, 3, func(c *log.Config) {
+		c.Retention.CheckInterval = 50 * time.Millisecond
+	})
+
+	require.NoError(t, logs[0].CreateTopic("orders", &api.TopicConfig{
+		MaxIndexBytes:     36,
+		RetentionMaxBytes: 120,
+	}))
+	for i := 0; i < 7; i++ {
+		_, err := logs[0].AppendRequest(&api.ProduceRequest{
+			Record: &api.Record{Value: []byte("test")},
+			Topic:  "orders",
+		})
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		for _, l := range logs {
+			if _, err := l.ReadTopic("orders", 0, 2); err == nil {
+				return false
+			}
+			if _, err := l.ReadTopic("orders", 0, 3); err != nil {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestTopics(t *testing.T) {
+	logs := setupCluster(t, 3, nil)
+
+	require.NoError(t, logs[0].CreateTopic("orders", &api.TopicConfig{
+		MaxIndexBytes: 24,
+	}))
+	require.Equal(
+		t,
+		api.ErrTopicExists{Topic: "orders"},
+		logs[0].CreateTopic("orders", nil),
+	)
+	require.NoError(t, logs[0].CreateTopic("billing", nil))
+
+	for i := 0; i < 3; i++ {
+		res, err := logs[0].AppendRequest(&api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("order %d", i))},
+			Topic:  "orders",
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Offset)
+	}
+	_, err := logs[0].AppendRequest(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("lost")},
+		Topic:  "missing",
+	})
+	require.Equal(t, api.ErrTopicNotFound{Topic: "missing"}, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, l := range logs {
+		require.NoError(t, l.WaitForTopicOffset(ctx, "orders", 0, 2))
+		record, err := l.ReadTopic("orders", 0, 1)
+		require.NoError(t, err)
+		require.Equal(t, []byte("order 1"), record.Value)
+		_, err = l.Read(0)
+		require.Error(t, err)
+
+		topics, err := l.ListTopics()
+		require.NoError(t, err)
+		require.Len(t, topics, 2)
+		require.Equal(t, "billing", topics[0].Name)
+		require.Equal(t, "orders", topics[1].Name)
+		require.Equal(t, uint64(24), topics[1].Config.MaxIndexBytes)
+	}
+
+	require.NoError(t, logs[0].DeleteTopic("orders"))
+	require.Eventually(t, func() bool {
+		for _, l := range logs {
+			_, err := l.ReadTopic("orders", 0, 0)
+			if err != (api.ErrTopicNotFound{Topic: "orders"}) {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	err = logs[1].CreateTopic("events", nil)
+	require.ErrorIs(t, err, raft.ErrNotLeader)
+}
+
+func TestPartitions(t *testing.T) {
+	logs := setupCluster(t, 2, func(c *log.Config) {
+		c.Partitioner = &log.RoundRobinPartitioner{}
+	})
+	require.NoError(t, logs[0].CreateTopic("orders", &api.TopicConfig{
+		Partitions: 3,
+	}))
+	id, err := logs[0].RegisterProducer()
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		res, err := logs[0].AppendRequest(&api.ProduceRequest{
+			Record:     &api.Record{Value: []byte(fmt.Sprintf("order %d", i))},
+			Topic:      "orders",
+			ProducerId: id,
+			Sequence:   uint64(i + 1),
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint32(i), res.Partition)
+		require.Equal(t, uint64(0), res.Offset)
+	}
+
+	explicit := func(p uint32) *uint32 { return &p }
+	tests := []struct {
+		name      string
+		req       *api.ProduceRequest
+		partition uint32
+		off       uint64
+		err       error
+	}{
+		{
+			name: "ok case resent",
+			req: &api.ProduceRequest{
+				Record:     &api.Record{Value: []byte("order 1")},
+				Topic:      "orders",
+				ProducerId: id,
+				Sequence:   2,
+			},
+			partition: 1,
+		},
+		{
+			name: "ok case explicit",
+			req: &api.ProduceRequest{
+				Record:    &api.Record{Value: []byte("order 3")},
+				Topic:     "orders",
+				Partition: explicit(2),
+			},
+			partition: 2,
+			off:       1,
+		},
+		{
+			name: "ng case past partitions",
+			req: &api.ProduceRequest{
+				Record:    &api.Record{Value: []byte("order 4")},
+				Topic:     "orders",
+				Partition: explicit(5),
+			},
+			err: api.ErrPartitionNotFound{Topic: "orders", Partition: 5},
+		},
+		{
+			name: "ng case default log",
+			req: &api.ProduceRequest{
+				Record:    &api.Record{Value: []byte("order 4")},
+				Partition: explicit(1),
+			},
+			err: api.ErrPartitionNotFound{Partition: 1},
+		},
+	}
+	for _, tt := range tests {
+		res, err := logs[0].AppendRequest(tt.req)
+		require.Equal(t, tt.err, err, tt.name)
+		require.Equal(t, tt.partition, res.GetPartition(), tt.name)
+		require.Equal(t, tt.off, res.GetOffset(), tt.name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, logs[1].WaitForTopicOffset(ctx, "orders", 2, 1))
+	for partition, v := range []string{"order 0", "order 1", "order 2"} {
+		record, err := logs[1].ReadTopic("orders", uint32(partition), 0)
+		require.NoError(t, err)
+		require.Equal(t, []byte(v), record.Value)
+	}
+
+	batch, err := logs[0].AppendBatchRequest(&api.ProduceBatchRequest{
+		Records: []*api.Record{
+			{Value: []byte("order 5")},
+			{Value: []byte("order 6")},
+		},
+		Topic:     "orders",
+		Partition: explicit(2),
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), batch.Partition)
+	require.Equal(t, uint64(2), batch.FirstOffset)
+	require.Equal(t, uint64(3), batch.LastOffset)
+	require.NoError(t, logs[1].WaitForTopicOffset(ctx, "orders", 2, 3))
+	records, err := logs[1].ReadTopicBatch("orders", 2, 2, 2, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, []byte("order 6"), records[1].Value)
+	info, err := logs[1].TopicInfo("orders", 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), info.HighestOffset)
+	require.False(t, info.IsLeader)
+
+	servers, err := logs[1].GetServers()
+	require.NoError(t, err)
+	require.Len(t, servers, 2)
+	for _, server := range servers {
+		require.Equal(t, map[string]uint32{"orders": 3}, server.Partitions)
+	}
+}
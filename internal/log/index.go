@@ -3,6 +3,7 @@ package log
 import (
 	"io"
 	"os"
+	"sort"
 
 	"github.com/tysonmote/gommap"
 )
@@ -42,10 +43,7 @@ func newIndex(f *os.File, c Config) (*index, error) {
 }
 
 func (i *index) Close() error {
-	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
-		return err
-	}
-	if err := i.file.Sync(); err != nil {
+	if err := i.Sync(); err != nil {
 		return err
 	}
 	if err := i.file.Truncate(int64(i.size)); err != nil {
@@ -54,6 +52,14 @@ func (i *index) Close() error {
 	return i.file.Close()
 }
 
+// Sync flushes the mapped entries to disk.
+func (i *index) Sync() error {
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	return i.file.Sync()
+}
+
 func (i *index) Read(in int64) (uint32, uint64, error) {
 	if i.size == 0 {
 		return 0, 0, io.EOF
@@ -83,6 +89,15 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+// Search returns the position of the first entry whose relative offset is
+// at least off, or the number of entries if there is none.
+func (i *index) Search(off uint32) int64 {
+	return int64(sort.Search(int(i.size/entWidth), func(j int) bool {
+		got, _, _ := i.Read(int64(j))
+		return got >= off
+	}))
+}
+
 func (i *index) isMaxed() bool {
 	return uint64(len(i.mmap)) < i.size+entWidth
 }
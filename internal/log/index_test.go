@@ -4,6 +4,7 @@ import (
 	"io"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/tysonmote/gommap"
@@ -19,6 +20,8 @@ func Test_newIndex(t *testing.T) {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 100,
 			MaxIndexBytes: 100,
@@ -75,6 +78,8 @@ func Test_index_Close(t *testing.T) {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 100,
 			MaxIndexBytes: 100,
@@ -119,6 +124,8 @@ func Test_index_Read(t *testing.T) {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 100,
 			MaxIndexBytes: 100,
@@ -214,6 +221,8 @@ func Test_index_Write(t *testing.T) {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 100,
 			MaxIndexBytes: 12,
@@ -267,6 +276,8 @@ func Test_index_isMaxed(t *testing.T) {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 100,
 			MaxIndexBytes: 12,
@@ -313,6 +324,8 @@ func Test_index_Name(t *testing.T) {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 100,
 			MaxIndexBytes: 12,
@@ -1,15 +1,21 @@
 package log
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/chmikata/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
 )
 
 type Log struct {
@@ -18,6 +24,13 @@ type Log struct {
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	// appended is closed and replaced whenever records are appended.
+	appended chan struct{}
+	// compactMu keeps compactions of the log from overlapping.
+	compactMu sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -35,6 +48,29 @@ func NewLog(dir string, c Config) (*Log, error) {
 }
 
 func (l *Log) setup() error {
+	// Compactions cut short leave their directories behind.
+	dirs, err := filepath.Glob(filepath.Join(l.Dir, compactDir+"*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	l.mu.Lock()
+	err = l.openSegments()
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	l.start()
+	return nil
+}
+
+// openSegments opens the segments in Dir, creating the first one if there
+// are none. The caller must hold the write lock.
+func (l *Log) openSegments() error {
 	if _, err := os.Stat(l.Dir); os.IsNotExist(err) {
 		if err := os.Mkdir(l.Dir, 0777); err != nil {
 			return err
@@ -46,11 +82,17 @@ func (l *Log) setup() error {
 	}
 	var baseOffsets []uint64
 	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
 		offStr := strings.TrimSuffix(
 			file.Name(),
 			path.Ext(file.Name()),
 		)
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			continue
+		}
 		baseOffsets = append(baseOffsets, off)
 	}
 	mOffsets := map[uint64]struct{}{}
@@ -74,13 +116,93 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
+	l.linkSegments()
+	// Wake readers still waiting on the log this one replaces after Reset.
+	l.notifyAppended()
 	return nil
 }
 
+// start runs the background work the config asks for.
+func (l *Log) start() {
+	l.done = make(chan struct{})
+	if l.Config.retentionEnabled() {
+		l.wg.Add(1)
+		go l.enforceRetention(l.done)
+	}
+	if !l.Config.replicated && (l.Config.Compaction.Enabled ||
+		l.Config.Compression.Codec != CodecNone) {
+		l.wg.Add(1)
+		go l.compactPeriodically(l.done)
+	}
+	if l.Config.Segment.Sync == SyncPeriodic {
+		l.wg.Add(1)
+		go l.syncPeriodically(l.done)
+	}
+}
+
+// stop waits for the background work started by start to finish.
+func (l *Log) stop() {
+	if l.done != nil {
+		close(l.done)
+		l.done = nil
+		l.wg.Wait()
+	}
+}
+
+// linkSegments extends each closed segment up to the base offset of the
+// next one, so that offsets compacted away from the end of a segment are
+// still found in it.
+func (l *Log) linkSegments() {
+	for i := 0; i < len(l.segments)-1; i++ {
+		l.segments[i].nextOffset = l.segments[i+1].baseOffset
+	}
+}
+
 func (l *Log) Append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	off, err := l.append(record)
+	if err != nil {
+		return 0, err
+	}
+	l.notifyAppended()
+	return off, l.syncAppended(l.activeSegment)
+}
+
+// AppendBatch appends records as one unit and returns the offset of the
+// first. Readers see either none or all of the records: the batch is
+// written under the write lock and rolled back if any record fails,
+// including segments created for it.
+func (l *Log) AppendBatch(records []*api.Record) (uint64, error) {
+	if len(records) == 0 {
+		return 0, fmt.Errorf("empty batch")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	active, n := l.activeSegment, len(l.segments)
+	m := active.mark()
+	var first uint64
+	for i, record := range records {
+		off, err := l.append(record)
+		if err != nil {
+			if rerr := l.rollback(active, n, m); rerr != nil {
+				return 0, rerr
+			}
+			return 0, err
+		}
+		if i == 0 {
+			first = off
+		}
+	}
+	l.notifyAppended()
+	return first, l.syncAppended(l.segments[n-1:]...)
+}
+
+// append appends record to the active segment, rolling to a new segment
+// when it is full. The caller must hold the write lock.
+func (l *Log) append(record *api.Record) (uint64, error) {
 	if l.activeSegment.IsMaxed() {
 		if err := l.newSegment(
 			l.activeSegment.nextOffset,
@@ -88,11 +210,169 @@ func (l *Log) Append(record *api.Record) (uint64, error) {
 			return 0, err
 		}
 	}
-	off, err := l.activeSegment.Append(record)
-	if err != nil {
-		return 0, err
+	return l.activeSegment.Append(record)
+}
+
+// rollback removes every segment past the first n and returns active to
+// the state in m.
+func (l *Log) rollback(active *segment, n int, m segmentMark) error {
+	for _, s := range l.segments[n:] {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
+	l.segments = l.segments[:n]
+	l.activeSegment = active
+	return active.rollback(m)
+}
+
+// write appends record under the offset it already carries rather than
+// assigning the next one, keeping the gaps of a compacted log.
+func (l *Log) write(record *api.Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.writeRecord(record); err != nil {
+		return err
+	}
+	l.notifyAppended()
+	return l.syncAppended(l.activeSegment)
+}
+
+// writeBatch writes records under the offsets they carry, like write, and
+// commits them to disk before it returns whatever the sync policy, so the
+// whole batch shares a single flush and fsync. Either all of the records
+// are written or none.
+func (l *Log) writeBatch(records []*api.Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	active, n := l.activeSegment, len(l.segments)
+	m := active.mark()
+	for _, record := range records {
+		if err := l.writeRecord(record); err != nil {
+			if rerr := l.rollback(active, n, m); rerr != nil {
+				return rerr
+			}
+			return err
+		}
+	}
+	l.notifyAppended()
+	for _, s := range l.segments[n-1:] {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRecord writes record to the active segment under its offset,
+// rolling to a new segment when it is full. The caller must hold the write
+// lock.
+func (l *Log) writeRecord(record *api.Record) error {
+	if record.Offset < l.activeSegment.nextOffset {
+		return fmt.Errorf(
+			"offset %d is below the next offset %d",
+			record.Offset, l.activeSegment.nextOffset,
+		)
+	}
+	if l.activeSegment.IsMaxed() {
+		if err := l.newSegment(
+			l.activeSegment.nextOffset,
+		); err != nil {
+			return err
+		}
+	}
+	return l.activeSegment.write(record)
+}
+
+// notifyAppended wakes every WaitForOffset call. The caller must hold the
+// write lock.
+func (l *Log) notifyAppended() {
+	if l.appended != nil {
+		close(l.appended)
+	}
+	l.appended = make(chan struct{})
+}
+
+// WaitForOffset blocks until the record at off has been appended or ctx is
+// done. It returns ErrOffsetOutOfRange if off has already been removed
+// from the log.
+func (l *Log) WaitForOffset(ctx context.Context, off uint64) error {
+	for {
+		l.mu.RLock()
+		open := len(l.segments) > 0
+		var lowest, next uint64
+		if open {
+			lowest = l.segments[0].baseOffset
+			next = l.activeSegment.nextOffset
+		}
+		appended := l.appended
+		l.mu.RUnlock()
+
+		if open && off < lowest {
+			return api.ErrOffsetOutOfRange{Offset: off, Removed: true}
+		}
+		if open && off < next {
+			return nil
+		}
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// syncAppended commits the segments just appended to if the sync policy
+// asks for it on every append. The caller must hold the write lock.
+func (l *Log) syncAppended(segments ...*segment) error {
+	if l.Config.Segment.Sync != SyncEveryAppend {
+		return nil
+	}
+	for _, s := range segments {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync commits every segment to disk.
+func (l *Log) Sync() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, s := range l.segments {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Log) syncPeriodically(done <-chan struct{}) {
+	defer l.wg.Done()
+
+	interval := l.Config.Segment.SyncInterval
+	if interval == 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := l.Sync(); err != nil {
+				zap.L().Named("log").Error(
+					"failed to sync log",
+					zap.Error(err),
+				)
+			}
+		}
 	}
-	return off, nil
 }
 
 func (l *Log) Read(off uint64) (*api.Record, error) {
@@ -107,16 +387,132 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 		}
 	}
 	if seg == nil {
-		return nil, api.ErrOffsetOutOfRange{Offset: off}
+		return nil, api.ErrOffsetOutOfRange{
+			Offset:  off,
+			Removed: off < l.segments[0].baseOffset,
+		}
 	}
 	return seg.Read(off)
 }
 
+// ReadBatch reads consecutive records starting at off, skipping offsets
+// removed by compaction. It stops after maxRecords records or before the
+// records would exceed maxBytes, a zero limit meaning none, but always
+// returns at least one record.
+func (l *Log) ReadBatch(off uint64, maxRecords int, maxBytes uint64) (
+	[]*api.Record, error,
+) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if off < l.segments[0].baseOffset {
+		return nil, api.ErrOffsetOutOfRange{Offset: off, Removed: true}
+	}
+	var (
+		records []*api.Record
+		size    uint64
+		next    = off
+	)
+	for _, s := range l.segments {
+		if next >= s.nextOffset {
+			continue
+		}
+		i := s.index.Search(uint32(next - s.baseOffset))
+		for ; i < int64(s.index.size/entWidth); i++ {
+			record, err := s.readEntry(i)
+			if err != nil {
+				return nil, err
+			}
+			n := uint64(proto.Size(record))
+			if len(records) > 0 && maxBytes != 0 && size+n > maxBytes {
+				return records, nil
+			}
+			records = append(records, record)
+			size += n
+			if maxRecords != 0 && len(records) == maxRecords {
+				return records, nil
+			}
+		}
+		next = s.nextOffset
+	}
+	if len(records) == 0 {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return records, nil
+}
+
+// ReadBarrier returns once a read at the given consistency may proceed. A
+// single log is always up to date, so only a minimum offset is waited for.
+func (l *Log) ReadBarrier(
+	ctx context.Context,
+	consistency api.ReadConsistency,
+	minOffset uint64,
+) error {
+	if consistency == api.ReadConsistency_READ_AT_LEAST_OFFSET {
+		return l.WaitForOffset(ctx, minOffset)
+	}
+	return nil
+}
+
+// RebuildIndex rebuilds the index of every segment from its store file.
+func (l *Log) RebuildIndex() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, s := range l.segments {
+		if err := s.reindex(); err != nil {
+			return err
+		}
+		s.readNextOffset()
+		if err := s.loadTimeIndex(); err != nil {
+			return err
+		}
+	}
+	l.linkSegments()
+	return nil
+}
+
+// OffsetForTime returns the first offset whose record was appended at or
+// after t. If no such record exists yet, the offset the next record will
+// be given is returned.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	ts := t.UnixNano()
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].maxTimestamp >= ts
+	})
+	for ; i < len(l.segments); i++ {
+		off, ok, err := l.segments[i].offsetForTime(ts)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return off, nil
+		}
+	}
+	return l.activeSegment.nextOffset, nil
+}
+
 func (l *Log) Close() error {
+	l.stop()
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	return l.closeSegments()
+}
+
+// closeSegments closes every segment, syncing it first unless the sync
+// policy leaves that to the OS. The caller must hold the write lock.
+func (l *Log) closeSegments() error {
 	for _, segment := range l.segments {
+		if l.Config.Segment.Sync != SyncOS {
+			if err := segment.Sync(); err != nil {
+				return err
+			}
+		}
 		if err := segment.Close(); err != nil {
 			return err
 		}
@@ -131,13 +527,23 @@ func (l *Log) Remove() error {
 	return os.RemoveAll(l.Dir)
 }
 
+// Reset removes every record and starts the log over from the initial
+// offset. Readers waiting on the log are woken once it is empty.
 func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
+	l.stop()
+	defer l.start()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.closeSegments(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(l.Dir); err != nil {
 		return err
 	}
-	l.activeSegment = nil
-	l.segments = nil
-	return l.setup()
+	l.segments, l.activeSegment = nil, nil
+	return l.openSegments()
 }
 
 func (l *Log) LowestOffset() (uint64, error) {
@@ -147,6 +553,19 @@ func (l *Log) LowestOffset() (uint64, error) {
 	return l.segments[0].baseOffset, nil
 }
 
+// lastOffset returns the offset of the last record, -1 if the log has no
+// records.
+func (l *Log) lastOffset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	next := l.activeSegment.nextOffset
+	if next == l.segments[0].baseOffset {
+		return -1
+	}
+	return int64(next) - 1
+}
+
 func (l *Log) HighestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
@@ -158,13 +577,46 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+// Info describes the range of offsets in the log and its segments.
+func (l *Log) Info() (*api.LogInfo, error) {
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	highest, err := l.HighestOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	info := &api.LogInfo{
+		LowestOffset:  lowest,
+		HighestOffset: highest,
+		NextOffset:    l.activeSegment.nextOffset,
+		SegmentCount:  uint32(len(l.segments)),
+	}
+	for _, s := range l.segments {
+		info.TotalBytes += s.store.size
+		info.Segments = append(info.Segments, &api.SegmentInfo{
+			BaseOffset:   s.baseOffset,
+			NextOffset:   s.nextOffset,
+			StoreBytes:   s.store.size,
+			IndexBytes:   s.index.size,
+			MaxTimestamp: s.maxTimestamp,
+		})
+	}
+	return info, nil
+}
+
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset-1 <= lowest {
+		if s != l.activeSegment && s.nextOffset-1 <= lowest {
 			if err := s.Remove(); err != nil {
 				return err
 			}
@@ -176,15 +628,112 @@ func (l *Log) Truncate(lowest uint64) error {
 	return nil
 }
 
+// TruncateSuffix removes every record at from or after it. Segments
+// starting at from or later are removed and the one holding from is cut
+// short and becomes the active segment, so appends continue right after
+// the last record kept. Removing every record leaves an empty segment at
+// from.
+func (l *Log) TruncateSuffix(from uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if from >= l.activeSegment.nextOffset {
+		return nil
+	}
+	n := len(l.segments)
+	for n > 0 && l.segments[n-1].baseOffset >= from {
+		n--
+	}
+	for _, s := range l.segments[n:] {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
+	l.segments = l.segments[:n]
+	if n == 0 {
+		return l.newSegment(from)
+	}
+	l.activeSegment = l.segments[n-1]
+	if err := l.activeSegment.truncate(from); err != nil {
+		return err
+	}
+	return l.syncAppended(l.activeSegment)
+}
+
+// expiredOffset returns the highest offset that may be dropped under the
+// retention policy in c. Only whole segments count, oldest first, and the
+// active segment is never expired.
+func (l *Log) expiredOffset(now time.Time, c Config) (uint64, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var total uint64
+	for _, s := range l.segments {
+		total += s.store.size
+	}
+	var (
+		lowest  uint64
+		expired bool
+	)
+	for _, s := range l.segments[:len(l.segments)-1] {
+		tooOld := c.Retention.MaxAge != 0 &&
+			s.maxTimestamp != 0 &&
+			now.Sub(time.Unix(0, s.maxTimestamp)) > c.Retention.MaxAge
+		tooBig := c.Retention.MaxBytes != 0 &&
+			total > c.Retention.MaxBytes
+		if !tooOld && !tooBig {
+			break
+		}
+		if s.nextOffset == s.baseOffset {
+			continue
+		}
+		total -= s.store.size
+		lowest, expired = s.nextOffset-1, true
+	}
+	return lowest, expired
+}
+
+func (l *Log) enforceRetention(done <-chan struct{}) {
+	defer l.wg.Done()
+
+	interval := l.Config.Retention.CheckInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			lowest, ok := l.expiredOffset(now, l.Config)
+			if !ok {
+				continue
+			}
+			if err := l.Truncate(lowest); err != nil {
+				zap.L().Named("log").Error(
+					"failed to enforce retention",
+					zap.Error(err),
+					zap.Uint64("lowest", lowest),
+				)
+			}
+		}
+	}
+}
+
 func (l *Log) Reader() io.Reader {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originReader{
-			s:   segment.store,
-			off: 0,
+		readers[i] = &decodingReader{
+			r: &originReader{
+				s:   segment.store,
+				off: int64(segment.store.start),
+			},
+			codec: segment.store.codec,
 		}
 	}
 	return io.MultiReader(readers...)
@@ -202,7 +751,10 @@ func (o *originReader) Read(p []byte) (int, error) {
 }
 
 func (l *Log) newSegment(off uint64) error {
-	s, err := newSegment(l.Dir, off, l.Config)
+	// Segments are written uncompressed and compressed once closed.
+	c := l.Config
+	c.Compression.Codec = CodecNone
+	s, err := newSegment(l.Dir, off, c)
 	if err != nil {
 		return err
 	}
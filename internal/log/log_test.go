@@ -1,14 +1,17 @@
 package log
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	api "github.com/chmikata/proglog/api/v1"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestNewLog(t *testing.T) {
@@ -16,12 +19,15 @@ func TestNewLog(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/0.store", dir))
 		os.Remove(fmt.Sprintf("%s/0.index", dir))
+		os.Remove(fmt.Sprintf("%s/0.timeindex", dir))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 100,
 			MaxIndexBytes: 100,
@@ -64,12 +70,15 @@ func TestLog_setup(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/0.store", dir))
 		os.Remove(fmt.Sprintf("%s/0.index", dir))
+		os.Remove(fmt.Sprintf("%s/0.timeindex", dir))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 100,
 			MaxIndexBytes: 100,
@@ -116,12 +125,15 @@ func TestLog_Append(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/0.store", dir))
 		os.Remove(fmt.Sprintf("%s/0.index", dir))
+		os.Remove(fmt.Sprintf("%s/0.timeindex", dir))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 128,
 			MaxIndexBytes: 128,
@@ -173,12 +185,15 @@ func TestLog_Read(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/0.store", dir))
 		os.Remove(fmt.Sprintf("%s/0.index", dir))
+		os.Remove(fmt.Sprintf("%s/0.timeindex", dir))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 128,
 			MaxIndexBytes: 128,
@@ -269,12 +284,15 @@ func TestLog_LowestOffset(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/10.store", dir))
 		os.Remove(fmt.Sprintf("%s/10.index", dir))
+		os.Remove(fmt.Sprintf("%s/10.timeindex", dir))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 128,
 			MaxIndexBytes: 128,
@@ -312,12 +330,15 @@ func TestLog_HighestOffset(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/10.store", dir))
 		os.Remove(fmt.Sprintf("%s/10.index", dir))
+		os.Remove(fmt.Sprintf("%s/10.timeindex", dir))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 128,
 			MaxIndexBytes: 128,
@@ -384,6 +405,7 @@ func TestLog_newSegment(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/20.store", dir))
 		os.Remove(fmt.Sprintf("%s/20.index", dir))
+		os.Remove(fmt.Sprintf("%s/20.timeindex", dir))
 	})
 	type fields struct {
 		Dir           string
@@ -409,6 +431,8 @@ func TestLog_newSegment(t *testing.T) {
 						MaxStoreBytes uint64
 						MaxIndexBytes uint64
 						InitialOffset uint64
+						Sync          SyncPolicy
+						SyncInterval  time.Duration
 					}{
 						MaxStoreBytes: 128,
 						MaxIndexBytes: 128,
@@ -449,14 +473,18 @@ func TestLog_Close(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/100.store", dir))
 		os.Remove(fmt.Sprintf("%s/100.index", dir))
+		os.Remove(fmt.Sprintf("%s/100.timeindex", dir))
 		os.Remove(fmt.Sprintf("%s/103.store", dir))
 		os.Remove(fmt.Sprintf("%s/103.index", dir))
+		os.Remove(fmt.Sprintf("%s/103.timeindex", dir))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 120,
 			MaxIndexBytes: 36,
@@ -475,9 +503,9 @@ func TestLog_Close(t *testing.T) {
 			log:  log,
 			assertion: func(tt assert.TestingT, err error, i ...interface{}) bool {
 				fi, _ := os.Stat(fmt.Sprintf("%s/100.store", dir))
-				assert.Equal(tt, int64(48), fi.Size())
+				assert.Equal(tt, int64(78), fi.Size())
 				fi, _ = os.Stat(fmt.Sprintf("%s/103.store", dir))
-				assert.Equal(tt, int64(48), fi.Size())
+				assert.Equal(tt, int64(78), fi.Size())
 				fi, _ = os.Stat(fmt.Sprintf("%s/100.index", dir))
 				assert.Equal(tt, int64(36), fi.Size())
 				fi, _ = os.Stat(fmt.Sprintf("%s/103.index", dir))
@@ -505,12 +533,15 @@ func TestLog_Remove(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/110.store", dir))
 		os.Remove(fmt.Sprintf("%s/110.index", dir))
+		os.Remove(fmt.Sprintf("%s/110.timeindex", dir))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 120,
 			MaxIndexBytes: 120,
@@ -546,12 +577,15 @@ func TestLog_Reset(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/120.store", dir))
 		os.Remove(fmt.Sprintf("%s/120.index", dir))
+		os.Remove(fmt.Sprintf("%s/120.timeindex", dir))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 120,
 			MaxIndexBytes: 120,
@@ -598,14 +632,21 @@ func TestLog_Truncate(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/130.store", dir))
 		os.Remove(fmt.Sprintf("%s/130.index", dir))
-		os.Remove(fmt.Sprintf("%s/138.store", dir))
-		os.Remove(fmt.Sprintf("%s/138.index", dir))
+		os.Remove(fmt.Sprintf("%s/130.timeindex", dir))
+		os.Remove(fmt.Sprintf("%s/135.store", dir))
+		os.Remove(fmt.Sprintf("%s/135.index", dir))
+		os.Remove(fmt.Sprintf("%s/135.timeindex", dir))
+		os.Remove(fmt.Sprintf("%s/140.store", dir))
+		os.Remove(fmt.Sprintf("%s/140.index", dir))
+		os.Remove(fmt.Sprintf("%s/140.timeindex", dir))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 120,
 			MaxIndexBytes: 120,
@@ -630,8 +671,14 @@ func TestLog_Truncate(t *testing.T) {
 			assertion: func(tt assert.TestingT, err error, i ...interface{}) bool {
 				assert.NoFileExists(tt, fmt.Sprintf("%s/130.store", dir))
 				assert.NoFileExists(tt, fmt.Sprintf("%s/130.index", dir))
-				assert.FileExists(tt, fmt.Sprintf("%s/138.store", dir))
-				assert.FileExists(tt, fmt.Sprintf("%s/138.index", dir))
+				assert.FileExists(tt, fmt.Sprintf("%s/135.store", dir))
+				assert.FileExists(tt, fmt.Sprintf("%s/135.index", dir))
+				_, rerr := log.Read(134)
+				assert.Equal(tt, api.ErrOffsetOutOfRange{Offset: 134, Removed: true}, rerr)
+				_, rerr = log.ReadBatch(134, 1, 0)
+				assert.Equal(tt, api.ErrOffsetOutOfRange{Offset: 134, Removed: true}, rerr)
+				_, rerr = log.Read(140)
+				assert.Equal(tt, api.ErrOffsetOutOfRange{Offset: 140}, rerr)
 				return assert.NoError(tt, err)
 			},
 			setup: func(l *Log) {
@@ -650,17 +697,85 @@ func TestLog_Truncate(t *testing.T) {
 	}
 }
 
+func TestLog_TruncateSuffix(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     uint64
+		segments int
+		next     uint64
+	}{
+		{
+			name:     "ok case middle of closed segment",
+			from:     4,
+			segments: 2,
+			next:     4,
+		},
+		{
+			name:     "ok case segment base",
+			from:     3,
+			segments: 1,
+			next:     3,
+		},
+		{
+			name:     "ok case everything",
+			from:     0,
+			segments: 1,
+			next:     0,
+		},
+		{
+			name:     "ok case past end",
+			from:     9,
+			segments: 3,
+			next:     7,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dir, _ := os.MkdirTemp("", "TestLog_TruncateSuffix")
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			c := Config{}
+			c.Segment.MaxIndexBytes = 36
+			log, _ := NewLog(dir, c)
+			for i := 0; i < 7; i++ {
+				log.Append(&api.Record{Value: []byte("test")})
+			}
+
+			assert.NoError(t, log.TruncateSuffix(tt.from))
+			assert.Equal(t, tt.segments, len(log.segments))
+			_, err := log.Read(tt.next)
+			assert.Equal(t, api.ErrOffsetOutOfRange{Offset: tt.next}, err)
+
+			// The truncation survives a restart.
+			assert.NoError(t, log.Close())
+			log, _ = NewLog(dir, c)
+			t.Cleanup(func() { log.Close() })
+			off, err := log.Append(&api.Record{Value: []byte("rewritten")})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.next, off)
+			if tt.next > 0 {
+				record, err := log.Read(tt.next - 1)
+				assert.NoError(t, err)
+				assert.Equal(t, []byte("test"), record.Value)
+			}
+		})
+	}
+}
+
 func TestLog_Reader(t *testing.T) {
 	dir := "/tmp/log_store"
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/140.store", dir))
 		os.Remove(fmt.Sprintf("%s/140.index", dir))
+		os.Remove(fmt.Sprintf("%s/140.timeindex", dir))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 120,
 			MaxIndexBytes: 120,
@@ -676,9 +791,11 @@ func TestLog_Reader(t *testing.T) {
 		{
 			name: "ok case",
 			log:  log,
-			want: io.MultiReader(&originReader{
-				s:   log.segments[0].store,
-				off: 0,
+			want: io.MultiReader(&decodingReader{
+				r: &originReader{
+					s:   log.segments[0].store,
+					off: 0,
+				},
 			}),
 		},
 	}
@@ -750,3 +867,626 @@ func Test_originReader_Read(t *testing.T) {
 		})
 	}
 }
+
+func TestLog_RebuildIndex(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "TestLog_RebuildIndex")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c := Config{
+		Segment: struct {
+			MaxStoreBytes uint64
+			MaxIndexBytes uint64
+			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
+		}{
+			MaxStoreBytes: 120,
+			MaxIndexBytes: 36,
+			InitialOffset: 160,
+		},
+	}
+	log, _ := NewLog(dir, c)
+	tests := []struct {
+		name      string
+		log       *Log
+		assertion assert.ErrorAssertionFunc
+		setup     func(*Log)
+	}{
+		{
+			name: "ok case",
+			log:  log,
+			assertion: func(tt assert.TestingT, err error, i ...interface{}) bool {
+				l := i[0].(*Log)
+				for off := uint64(160); off < 166; off++ {
+					record, err := l.Read(off)
+					if assert.NoError(tt, err) {
+						assert.Equal(tt, off, record.Offset)
+					}
+				}
+				assert.Equal(tt, uint64(166), l.activeSegment.nextOffset)
+				return assert.NoError(tt, err)
+			},
+			setup: func(l *Log) {
+				for i := 0; i < 6; i++ {
+					l.Append(&api.Record{Value: []byte("test")})
+				}
+				for _, s := range l.segments {
+					copy(s.index.mmap[entWidth:], make([]byte, entWidth))
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup(tt.log)
+			tt.assertion(t, tt.log.RebuildIndex(), tt.log)
+		})
+	}
+}
+
+func TestLog_OffsetForTime(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "TestLog_OffsetForTime")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c := Config{
+		Segment: struct {
+			MaxStoreBytes uint64
+			MaxIndexBytes uint64
+			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
+		}{
+			MaxStoreBytes: 1024,
+			MaxIndexBytes: 36,
+			InitialOffset: 170,
+		},
+	}
+	log, _ := NewLog(dir, c)
+	base := time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 8; i++ {
+		log.Append(&api.Record{
+			Value:     []byte("test"),
+			Timestamp: base.Add(time.Duration(i) * time.Minute).UnixNano(),
+		})
+	}
+	type args struct {
+		t time.Time
+	}
+	tests := []struct {
+		name      string
+		log       *Log
+		args      args
+		want      uint64
+		assertion assert.ErrorAssertionFunc
+	}{
+		{
+			name:      "ok case before first record",
+			log:       log,
+			args:      args{t: base.Add(-time.Hour)},
+			want:      170,
+			assertion: assert.NoError,
+		},
+		{
+			name:      "ok case exact timestamp",
+			log:       log,
+			args:      args{t: base.Add(4 * time.Minute)},
+			want:      174,
+			assertion: assert.NoError,
+		},
+		{
+			name:      "ok case between records",
+			log:       log,
+			args:      args{t: base.Add(5*time.Minute + time.Second)},
+			want:      176,
+			assertion: assert.NoError,
+		},
+		{
+			name:      "ok case after last record",
+			log:       log,
+			args:      args{t: base.Add(time.Hour)},
+			want:      178,
+			assertion: assert.NoError,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.log.OffsetForTime(tt.args.t)
+			tt.assertion(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLog_expiredOffset(t *testing.T) {
+	now := time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC)
+	newTestLog := func(maxBytes uint64, maxAge time.Duration) *Log {
+		dir, _ := os.MkdirTemp("", "TestLog_expiredOffset")
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		c := Config{}
+		c.Segment.MaxIndexBytes = 36
+		c.Retention.MaxBytes = maxBytes
+		c.Retention.MaxAge = maxAge
+		c.Retention.CheckInterval = time.Hour
+		log, _ := NewLog(dir, c)
+		for i := 0; i < 7; i++ {
+			log.Append(&api.Record{
+				Value:     []byte("test"),
+				Timestamp: now.Add(time.Duration(i-7) * time.Hour).UnixNano(),
+			})
+		}
+		return log
+	}
+	tests := []struct {
+		name  string
+		log   *Log
+		want  uint64
+		want1 bool
+	}{
+		{
+			name:  "ok case within policy",
+			log:   newTestLog(1024, 24*time.Hour),
+			want:  0,
+			want1: false,
+		},
+		{
+			name:  "ok case max bytes",
+			log:   newTestLog(120, 0),
+			want:  2,
+			want1: true,
+		},
+		{
+			name:  "ok case max age",
+			log:   newTestLog(0, 90*time.Minute),
+			want:  5,
+			want1: true,
+		},
+		{
+			name:  "ok case never active segment",
+			log:   newTestLog(1, time.Nanosecond),
+			want:  5,
+			want1: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, got1 := tt.log.expiredOffset(now, tt.log.Config)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.want1, got1)
+			assert.NoError(t, tt.log.Close())
+		})
+	}
+}
+
+func TestLog_enforceRetention(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "TestLog_enforceRetention")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c := Config{}
+	c.Segment.MaxIndexBytes = 36
+	c.Retention.MaxBytes = 120
+	c.Retention.CheckInterval = 10 * time.Millisecond
+	log, _ := NewLog(dir, c)
+	for i := 0; i < 7; i++ {
+		log.Append(&api.Record{Value: []byte("test")})
+	}
+	assert.Eventually(t, func() bool {
+		lowest, _ := log.LowestOffset()
+		return lowest == 3
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, log.Close())
+}
+
+func TestLog_AppendBatch(t *testing.T) {
+	newTestLog := func() *Log {
+		dir, _ := os.MkdirTemp("", "TestLog_AppendBatch")
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		c := Config{}
+		c.Segment.MaxIndexBytes = 36
+		log, _ := NewLog(dir, c)
+		log.Append(&api.Record{Value: []byte("test")})
+		return log
+	}
+	batch := func(n int) []*api.Record {
+		records := make([]*api.Record, n)
+		for i := range records {
+			records[i] = &api.Record{Value: []byte("batch")}
+		}
+		return records
+	}
+	type args struct {
+		records []*api.Record
+	}
+	tests := []struct {
+		name      string
+		log       *Log
+		args      args
+		want      uint64
+		segments  int
+		assertion assert.ErrorAssertionFunc
+	}{
+		{
+			name:      "ok case within segment",
+			log:       newTestLog(),
+			args:      args{records: batch(2)},
+			want:      1,
+			segments:  1,
+			assertion: assert.NoError,
+		},
+		{
+			name:      "ok case across segments",
+			log:       newTestLog(),
+			args:      args{records: batch(5)},
+			want:      1,
+			segments:  2,
+			assertion: assert.NoError,
+		},
+		{
+			name:      "error case empty batch",
+			log:       newTestLog(),
+			args:      args{records: nil},
+			want:      0,
+			segments:  1,
+			assertion: assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.log.AppendBatch(tt.args.records)
+			tt.assertion(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Len(t, tt.log.segments, tt.segments)
+			for i := range tt.args.records {
+				record, err := tt.log.Read(got + uint64(i))
+				if assert.NoError(t, err) {
+					assert.Equal(t, []byte("batch"), record.Value)
+				}
+			}
+			assert.NoError(t, tt.log.Close())
+		})
+	}
+}
+
+func TestLog_rollback(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "TestLog_rollback")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c := Config{}
+	c.Segment.MaxIndexBytes = 36
+	log, _ := NewLog(dir, c)
+	log.Append(&api.Record{Value: []byte("test")})
+
+	active, n := log.activeSegment, len(log.segments)
+	m := active.mark()
+	for i := 0; i < 4; i++ {
+		_, err := log.append(&api.Record{Value: []byte("partial")})
+		assert.NoError(t, err)
+	}
+	assert.Len(t, log.segments, 2)
+	assert.NoError(t, log.rollback(active, n, m))
+
+	assert.Len(t, log.segments, 1)
+	_, err := log.Read(1)
+	assert.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	_, err = os.Stat(fmt.Sprintf("%s/3.store", dir))
+	assert.True(t, os.IsNotExist(err))
+
+	off, err := log.Append(&api.Record{Value: []byte("next")})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), off)
+	record, err := log.Read(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("next"), record.Value)
+	assert.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), log.activeSegment.nextOffset)
+	assert.NoError(t, log.Close())
+}
+
+func TestLog_Sync(t *testing.T) {
+	newTestLog := func(policy SyncPolicy) *Log {
+		dir, _ := os.MkdirTemp("", "TestLog_Sync")
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		c := Config{}
+		c.Segment.Sync = policy
+		c.Segment.SyncInterval = 10 * time.Millisecond
+		log, _ := NewLog(dir, c)
+		return log
+	}
+	onDisk := func(log *Log) int64 {
+		fi, _ := os.Stat(log.activeSegment.store.Name())
+		return fi.Size()
+	}
+	tests := []struct {
+		name string
+		log  *Log
+		// synced reports whether the append reached the file without an
+		// explicit Log.Sync.
+		synced func(log *Log) bool
+	}{
+		{
+			name: "ok case os managed",
+			log:  newTestLog(SyncOS),
+			synced: func(log *Log) bool {
+				return onDisk(log) == 0
+			},
+		},
+		{
+			name: "ok case every append",
+			log:  newTestLog(SyncEveryAppend),
+			synced: func(log *Log) bool {
+				return onDisk(log) == int64(log.activeSegment.store.size)
+			},
+		},
+		{
+			name: "ok case periodic",
+			log:  newTestLog(SyncPeriodic),
+			synced: func(log *Log) bool {
+				return assert.Eventually(t, func() bool {
+					return onDisk(log) == int64(log.activeSegment.store.size)
+				}, time.Second, 10*time.Millisecond)
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.log.Append(&api.Record{Value: []byte("test")})
+			assert.NoError(t, err)
+			assert.True(t, tt.synced(tt.log))
+			assert.NoError(t, tt.log.Sync())
+			assert.Equal(t, int64(tt.log.activeSegment.store.size), onDisk(tt.log))
+			assert.NoError(t, tt.log.Close())
+		})
+	}
+}
+
+func TestLog_WaitForOffset(t *testing.T) {
+	newTestLog := func() *Log {
+		dir, _ := os.MkdirTemp("", "TestLog_WaitForOffset")
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		c := Config{}
+		c.Segment.MaxIndexBytes = 36
+		log, _ := NewLog(dir, c)
+		for i := 0; i < 4; i++ {
+			log.Append(&api.Record{Value: []byte("test")})
+		}
+		t.Cleanup(func() { log.Close() })
+		return log
+	}
+	type args struct {
+		off     uint64
+		timeout time.Duration
+	}
+	tests := []struct {
+		name      string
+		log       *Log
+		args      args
+		setup     func(log *Log)
+		assertion assert.ErrorAssertionFunc
+	}{
+		{
+			name:      "ok case already appended",
+			log:       newTestLog(),
+			args:      args{off: 3, timeout: time.Second},
+			setup:     func(log *Log) {},
+			assertion: assert.NoError,
+		},
+		{
+			name: "ok case appended while waiting",
+			log:  newTestLog(),
+			args: args{off: 5, timeout: time.Second},
+			setup: func(log *Log) {
+				go func() {
+					log.Append(&api.Record{Value: []byte("test")})
+					time.Sleep(10 * time.Millisecond)
+					log.AppendBatch([]*api.Record{{Value: []byte("test")}})
+				}()
+			},
+			assertion: assert.NoError,
+		},
+		{
+			name: "ok case reset while waiting",
+			log:  newTestLog(),
+			args: args{off: 5, timeout: time.Second},
+			setup: func(log *Log) {
+				go func() {
+					time.Sleep(10 * time.Millisecond)
+					log.Reset()
+					records := make([]*api.Record, 6)
+					for i := range records {
+						records[i] = &api.Record{Value: []byte("test")}
+					}
+					log.AppendBatch(records)
+				}()
+			},
+			assertion: assert.NoError,
+		},
+		{
+			name:  "error case context done",
+			log:   newTestLog(),
+			args:  args{off: 4, timeout: 10 * time.Millisecond},
+			setup: func(log *Log) {},
+			assertion: func(tt assert.TestingT, err error, i ...interface{}) bool {
+				return assert.ErrorIs(tt, err, context.DeadlineExceeded)
+			},
+		},
+		{
+			name: "error case truncated",
+			log:  newTestLog(),
+			args: args{off: 1, timeout: time.Second},
+			setup: func(log *Log) {
+				log.Truncate(2)
+			},
+			assertion: func(tt assert.TestingT, err error, i ...interface{}) bool {
+				return assert.Equal(tt, api.ErrOffsetOutOfRange{Offset: 1, Removed: true}, err)
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tt.args.timeout)
+			defer cancel()
+			tt.setup(tt.log)
+			tt.assertion(t, tt.log.WaitForOffset(ctx, tt.args.off))
+		})
+	}
+}
+
+func TestLog_ResetWhileWaiting(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "TestLog_ResetWhileWaiting")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	log, _ := NewLog(dir, Config{})
+	t.Cleanup(func() { log.Close() })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, log.Reset())
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		log.Append(&api.Record{Value: []byte("test")})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		err := log.WaitForOffset(ctx, 0)
+		cancel()
+		if err != nil {
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		}
+	}
+}
+
+func TestLog_ReadBatch(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "TestLog_ReadBatch")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c := Config{}
+	c.Segment.MaxIndexBytes = 36
+	log, _ := NewLog(dir, c)
+	t.Cleanup(func() { log.Close() })
+	for i := 0; i < 7; i++ {
+		log.Append(&api.Record{Value: []byte("test"), Timestamp: 1})
+	}
+	size := uint64(proto.Size(&api.Record{Value: []byte("test"), Offset: 1, Timestamp: 1}))
+	type args struct {
+		off        uint64
+		maxRecords int
+		maxBytes   uint64
+	}
+	tests := []struct {
+		name      string
+		args      args
+		want      []uint64
+		assertion assert.ErrorAssertionFunc
+	}{
+		{
+			name:      "ok case max records",
+			args:      args{off: 1, maxRecords: 2},
+			want:      []uint64{1, 2},
+			assertion: assert.NoError,
+		},
+		{
+			name:      "ok case across segments",
+			args:      args{off: 1},
+			want:      []uint64{1, 2, 3, 4, 5, 6},
+			assertion: assert.NoError,
+		},
+		{
+			name:      "ok case max bytes",
+			args:      args{off: 2, maxBytes: 2*size + 1},
+			want:      []uint64{2, 3},
+			assertion: assert.NoError,
+		},
+		{
+			name:      "ok case record larger than max bytes",
+			args:      args{off: 5, maxBytes: 1},
+			want:      []uint64{5},
+			assertion: assert.NoError,
+		},
+		{
+			name: "error case past end",
+			args: args{off: 7, maxRecords: 2},
+			want: nil,
+			assertion: func(tt assert.TestingT, err error, i ...interface{}) bool {
+				return assert.Equal(tt, api.ErrOffsetOutOfRange{Offset: 7}, err)
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := log.ReadBatch(tt.args.off, tt.args.maxRecords, tt.args.maxBytes)
+			tt.assertion(t, err)
+			var offsets []uint64
+			for _, record := range got {
+				offsets = append(offsets, record.Offset)
+			}
+			assert.Equal(t, tt.want, offsets)
+		})
+	}
+}
+
+func TestLog_Info(t *testing.T) {
+	newTestLog := func(n int) *Log {
+		dir, _ := os.MkdirTemp("", "TestLog_Info")
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		c := Config{}
+		c.Segment.MaxIndexBytes = 36
+		c.Segment.InitialOffset = 10
+		log, _ := NewLog(dir, c)
+		t.Cleanup(func() { log.Close() })
+		for i := 0; i < n; i++ {
+			log.Append(&api.Record{Value: []byte("test"), Timestamp: 1})
+		}
+		return log
+	}
+	tests := []struct {
+		name string
+		log  *Log
+		want *api.LogInfo
+	}{
+		{
+			name: "ok case empty",
+			log:  newTestLog(0),
+			want: &api.LogInfo{
+				LowestOffset:  10,
+				HighestOffset: 9,
+				NextOffset:    10,
+				SegmentCount:  1,
+				Segments: []*api.SegmentInfo{
+					{BaseOffset: 10, NextOffset: 10},
+				},
+			},
+		},
+		{
+			name: "ok case two segments",
+			log:  newTestLog(4),
+			want: &api.LogInfo{
+				LowestOffset:  10,
+				HighestOffset: 13,
+				NextOffset:    14,
+				SegmentCount:  2,
+				TotalBytes:    4 * 18,
+				Segments: []*api.SegmentInfo{
+					{BaseOffset: 10, NextOffset: 13, StoreBytes: 3 * 18, IndexBytes: 36, MaxTimestamp: 1},
+					{BaseOffset: 13, NextOffset: 14, StoreBytes: 18, IndexBytes: 12, MaxTimestamp: 1},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.log.Info()
+			assert.NoError(t, err)
+			assert.True(t, proto.Equal(tt.want, got), "got %v", got)
+		})
+	}
+}
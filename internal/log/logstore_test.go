@@ -0,0 +1,371 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/chmikata/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+func TestLogStore_DeleteRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max uint64
+		first    uint64
+		last     uint64
+	}{
+		{
+			name:  "ok case suffix",
+			min:   5,
+			max:   7,
+			first: 1,
+			last:  4,
+		},
+		{
+			name:  "ok case prefix",
+			min:   1,
+			max:   3,
+			first: 4,
+			last:  7,
+		},
+		{
+			name:  "ok case everything",
+			min:   1,
+			max:   7,
+			first: 0,
+			last:  0,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "TestLogStore_DeleteRange")
+			require.NoError(t, err)
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			c := Config{}
+			c.Segment.MaxIndexBytes = 3 * entWidth
+			c.Segment.InitialOffset = 1
+			logs, err := newLogSotre(dir, c)
+			require.NoError(t, err)
+			t.Cleanup(func() { logs.Close() })
+			var entries []*raft.Log
+			for i := uint64(1); i <= 7; i++ {
+				entries = append(entries, &raft.Log{
+					Index: i,
+					Term:  1,
+					Data:  []byte(fmt.Sprintf("entry %d", i)),
+				})
+			}
+			require.NoError(t, logs.StoreLogs(entries))
+
+			require.NoError(t, logs.DeleteRange(tt.min, tt.max))
+			first, err := logs.FirstIndex()
+			require.NoError(t, err)
+			require.Equal(t, tt.first, first)
+			last, err := logs.LastIndex()
+			require.NoError(t, err)
+			require.Equal(t, tt.last, last)
+			var entry raft.Log
+			require.Equal(t, raft.ErrLogNotFound, logs.GetLog(tt.max, &entry))
+
+			// Raft stores the next entry right after what it kept, or, once
+			// everything is gone, after the deleted range.
+			next := tt.last + 1
+			if tt.last == 0 {
+				next = tt.max + 1
+			}
+			require.NoError(t, logs.StoreLog(&raft.Log{
+				Index: next,
+				Term:  2,
+				Data:  []byte("rewritten"),
+			}))
+			require.NoError(t, logs.GetLog(next, &entry))
+			require.Equal(t, []byte("rewritten"), entry.Data)
+			require.Equal(t, uint64(2), entry.Term)
+			if tt.first == 0 {
+				tt.first = next
+			}
+			first, err = logs.FirstIndex()
+			require.NoError(t, err)
+			require.Equal(t, tt.first, first)
+		})
+	}
+}
+
+// TestLogStore_StoreLogsCrash copies the files of a log store while it is
+// still open, which is what a killed process leaves behind, and checks that
+// every acknowledged entry can be read back from the copy.
+func TestLogStore_StoreLogsCrash(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestLogStore_StoreLogsCrash")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c := Config{}
+	c.Segment.MaxIndexBytes = 3 * entWidth
+	c.Segment.InitialOffset = 1
+	logs, err := newLogSotre(filepath.Join(dir, "log"), c)
+	require.NoError(t, err)
+	t.Cleanup(func() { logs.Close() })
+
+	var index uint64
+	for _, n := range []int{1, 4, 2} {
+		var entries []*raft.Log
+		for i := 0; i < n; i++ {
+			index++
+			entries = append(entries, &raft.Log{
+				Index: index,
+				Term:  1,
+				Data:  []byte(fmt.Sprintf("entry %d", index)),
+			})
+		}
+		require.NoError(t, logs.StoreLogs(entries))
+	}
+
+	// A batch that would rewrite a stored entry is rejected as a whole.
+	require.Error(t, logs.StoreLogs([]*raft.Log{
+		{Index: index + 1, Term: 2},
+		{Index: index, Term: 2},
+	}))
+
+	crashed := filepath.Join(dir, "crashed")
+	require.NoError(t, os.Mkdir(crashed, 0755))
+	files, err := os.ReadDir(logs.Dir)
+	require.NoError(t, err)
+	for _, file := range files {
+		b, err := os.ReadFile(filepath.Join(logs.Dir, file.Name()))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(crashed, file.Name()), b, 0600))
+	}
+
+	restarted, err := newLogSotre(crashed, c)
+	require.NoError(t, err)
+	t.Cleanup(func() { restarted.Close() })
+	last, err := restarted.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, index, last)
+	for i := uint64(1); i <= index; i++ {
+		var entry raft.Log
+		require.NoError(t, restarted.GetLog(i, &entry))
+		require.Equal(t, []byte(fmt.Sprintf("entry %d", i)), entry.Data)
+	}
+}
+
+// TestLogStore_ConflictingSuffix isolates a leader while it still appends
+// entries that never commit. Once it rejoins, the new leader's entries must
+// replace them in its log.
+func TestLogStore_ConflictingSuffix(t *testing.T) {
+	type node struct {
+		raft  *raft.Raft
+		logs  *logStore
+		fsm   *raft.MockFSM
+		addr  raft.ServerAddress
+		trans *raft.InmemTransport
+	}
+	nodes := make([]*node, 3)
+	var servers []raft.Server
+	for i := range nodes {
+		addr, trans := raft.NewInmemTransport("")
+		nodes[i] = &node{addr: addr, trans: trans, fsm: &raft.MockFSM{}}
+		servers = append(servers, raft.Server{
+			ID:      raft.ServerID(fmt.Sprint(i)),
+			Address: addr,
+		})
+	}
+	connect := func() {
+		for _, a := range nodes {
+			for _, b := range nodes {
+				if a != b {
+					a.trans.Connect(b.addr, b.trans)
+				}
+			}
+		}
+	}
+	connect()
+	for i, n := range nodes {
+		dir, err := os.MkdirTemp("", "TestLogStore_ConflictingSuffix")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		c := Config{}
+		c.Segment.InitialOffset = 1
+		n.logs, err = newLogSotre(dir, c)
+		require.NoError(t, err)
+
+		config := raft.DefaultConfig()
+		config.LocalID = servers[i].ID
+		config.HeartbeatTimeout = 50 * time.Millisecond
+		config.ElectionTimeout = 50 * time.Millisecond
+		config.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.CommitTimeout = 5 * time.Millisecond
+		config.LogOutput = io.Discard
+		n.raft, err = raft.NewRaft(
+			config,
+			n.fsm,
+			n.logs,
+			raft.NewInmemStore(),
+			raft.NewInmemSnapshotStore(),
+			n.trans,
+		)
+		require.NoError(t, err)
+		n := n
+		t.Cleanup(func() {
+			n.raft.Shutdown().Error()
+			n.logs.Close()
+		})
+	}
+	require.NoError(t, nodes[0].raft.BootstrapCluster(raft.Configuration{
+		Servers: servers,
+	}).Error())
+
+	leader := func(except *node) *node {
+		var found *node
+		require.Eventually(t, func() bool {
+			for _, n := range nodes {
+				if n != except && n.raft.State() == raft.Leader {
+					found = n
+					return true
+				}
+			}
+			return false
+		}, 3*time.Second, 10*time.Millisecond)
+		return found
+	}
+	old := leader(nil)
+	require.NoError(t, old.raft.Apply([]byte("committed"), time.Second).Error())
+
+	old.trans.DisconnectAll()
+	for _, n := range nodes {
+		n.trans.Disconnect(old.addr)
+	}
+	last, err := old.logs.LastIndex()
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		old.raft.Apply([]byte(fmt.Sprintf("lost %d", i)), 0)
+	}
+	require.Eventually(t, func() bool {
+		got, err := old.logs.LastIndex()
+		return err == nil && got == last+3
+	}, time.Second, 10*time.Millisecond)
+
+	current := leader(old)
+	for i := 0; i < 4; i++ {
+		future := current.raft.Apply([]byte(fmt.Sprintf("won %d", i)), time.Second)
+		require.NoError(t, future.Error())
+	}
+	connect()
+
+	require.Eventually(t, func() bool {
+		if old.raft.AppliedIndex() != current.raft.AppliedIndex() {
+			return false
+		}
+		want, err := current.logs.LastIndex()
+		if err != nil {
+			return false
+		}
+		got, err := old.logs.LastIndex()
+		return err == nil && got == want
+	}, 3*time.Second, 10*time.Millisecond)
+	first, err := current.logs.FirstIndex()
+	require.NoError(t, err)
+	last, err = current.logs.LastIndex()
+	require.NoError(t, err)
+	for i := first; i <= last; i++ {
+		var want, got raft.Log
+		require.NoError(t, current.logs.GetLog(i, &want))
+		require.NoError(t, old.logs.GetLog(i, &got))
+		require.Equal(t, want.Term, got.Term, i)
+		require.Equal(t, want.Data, got.Data, i)
+	}
+	// Entries reach the FSM after the applied index moves on.
+	require.Eventually(t, func() bool {
+		return len(old.fsm.Logs()) == len(current.fsm.Logs())
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, current.fsm.Logs(), old.fsm.Logs())
+}
+
+// TestLogStore_Snapshot takes a snapshot and checks that the Raft log drops
+// the segments it covers, then that a node joining afterwards catches up
+// from the snapshot.
+func TestLogStore_Snapshot(t *testing.T) {
+	ports := dynaport.Get(2)
+	newNode := func(i int) *DistributedLog {
+		dir, err := os.MkdirTemp("", "TestLogStore_Snapshot")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+
+		c := Config{}
+		c.Segment.MaxIndexBytes = 3 * entWidth
+		c.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		c.Raft.LocalID = raft.ServerID(fmt.Sprint(i))
+		c.Raft.HeartbeatTimeout = 100 * time.Millisecond
+		c.Raft.ElectionTimeout = 100 * time.Millisecond
+		c.Raft.LeaderLeaseTimeout = 100 * time.Millisecond
+		c.Raft.CommitTimeout = 5 * time.Millisecond
+		c.Raft.BindAddr = ln.Addr().String()
+		c.Raft.SnapshotThreshold = 1 << 20
+		c.Raft.TrailingLogs = 2
+		c.Raft.BootStrap = i == 0
+		l, err := NewDistributedLog(dir, c)
+		require.NoError(t, err)
+		t.Cleanup(func() { l.Close() })
+		return l
+	}
+
+	leader := newNode(0)
+	require.NoError(t, leader.WaitForLeader(3*time.Second))
+	// Nothing has been applied yet, so there is no snapshot to take.
+	info, err := leader.Snapshot()
+	require.NoError(t, err)
+	require.Nil(t, info)
+
+	for i := 0; i < 10; i++ {
+		_, err := leader.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	segments := len(leader.raftLog.segments)
+	before := time.Now().UnixNano()
+	info, err = leader.Snapshot()
+	require.NoError(t, err)
+	last, err := leader.raftLog.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, last, info.Index)
+	require.GreaterOrEqual(t, info.TakenAt, before)
+	require.NotZero(t, info.SizeBytes)
+	require.NotZero(t, info.SegmentBytes)
+
+	first, err := leader.raftLog.FirstIndex()
+	require.NoError(t, err)
+	require.Greater(t, first, uint64(1))
+	require.GreaterOrEqual(t, first, last-2-3)
+	require.Less(t, len(leader.raftLog.segments), segments)
+
+	// Nothing new to snapshot reports the same snapshot.
+	again, err := leader.Snapshot()
+	require.NoError(t, err)
+	require.Equal(t, info.Id, again.Id)
+
+	follower := newNode(1)
+	require.NoError(t, leader.Join("1", follower.config.Raft.BindAddr))
+	require.Eventually(t, func() bool {
+		for i := 0; i < 10; i++ {
+			record, err := follower.Read(uint64(i))
+			if err != nil || string(record.Value) != fmt.Sprintf("record %d", i) {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+	// The entries were gone, so the follower installed the snapshot.
+	installed, err := follower.lastSnapshot()
+	require.NoError(t, err)
+	require.Equal(t, info.Index, installed.Index)
+	require.Equal(t, info.TakenAt, installed.TakenAt)
+}
@@ -0,0 +1,66 @@
+package log
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+
+	api "github.com/chmikata/proglog/api/v1"
+)
+
+// Partitioner chooses the partition of a topic that the record of a
+// ProduceRequest naming no partition is appended to.
+type Partitioner interface {
+	Partition(req *api.ProduceRequest, partitions uint32) (uint32, error)
+}
+
+var (
+	_ Partitioner = (*HashPartitioner)(nil)
+	_ Partitioner = (*RoundRobinPartitioner)(nil)
+	_ Partitioner = ExplicitPartitioner{}
+)
+
+// HashPartitioner appends records with the same key to the same partition,
+// so they stay in order. Records without a key are spread round-robin.
+type HashPartitioner struct {
+	RoundRobinPartitioner
+}
+
+func (p *HashPartitioner) Partition(req *api.ProduceRequest, partitions uint32) (uint32, error) {
+	if len(req.Record.Key) == 0 {
+		return p.RoundRobinPartitioner.Partition(req, partitions)
+	}
+	h := fnv.New32a()
+	h.Write(req.Record.Key)
+	return h.Sum32() % partitions, nil
+}
+
+// RoundRobinPartitioner spreads records evenly over the partitions.
+type RoundRobinPartitioner struct {
+	next uint32
+}
+
+func (p *RoundRobinPartitioner) Partition(_ *api.ProduceRequest, partitions uint32) (uint32, error) {
+	return (atomic.AddUint32(&p.next, 1) - 1) % partitions, nil
+}
+
+// ExplicitPartitioner leaves choosing the partition to producers and fails
+// records that don't name one.
+type ExplicitPartitioner struct{}
+
+func (ExplicitPartitioner) Partition(req *api.ProduceRequest, _ uint32) (uint32, error) {
+	return 0, api.ErrPartitionRequired{Topic: req.Topic}
+}
+
+// ParsePartitioner returns the partitioner with the given name.
+func ParsePartitioner(name string) (Partitioner, error) {
+	switch name {
+	case "", "hash":
+		return &HashPartitioner{}, nil
+	case "round-robin":
+		return &RoundRobinPartitioner{}, nil
+	case "explicit":
+		return ExplicitPartitioner{}, nil
+	}
+	return nil, fmt.Errorf("unknown partitioner: %q", name)
+}
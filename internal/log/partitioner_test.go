@@ -0,0 +1,69 @@
+package log
+
+import (
+	"testing"
+
+	api "github.com/chmikata/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitioner(t *testing.T) {
+	keyed := func(key string) *api.ProduceRequest {
+		return &api.ProduceRequest{
+			Record: &api.Record{Key: []byte(key)},
+			Topic:  "orders",
+		}
+	}
+
+	tests := []struct {
+		name        string
+		partitioner string
+		reqs        []*api.ProduceRequest
+		want        []uint32
+		err         error
+	}{
+		{
+			name:        "ok case hash same key",
+			partitioner: "hash",
+			reqs:        []*api.ProduceRequest{keyed("a"), keyed("c"), keyed("a")},
+			want:        []uint32{1, 2, 1},
+		},
+		{
+			name:        "ok case hash without key",
+			partitioner: "",
+			reqs:        []*api.ProduceRequest{keyed(""), keyed(""), keyed("")},
+			want:        []uint32{0, 1, 2},
+		},
+		{
+			name:        "ok case round robin",
+			partitioner: "round-robin",
+			reqs:        []*api.ProduceRequest{keyed("a"), keyed("a"), keyed("a"), keyed("a")},
+			want:        []uint32{0, 1, 2, 0},
+		},
+		{
+			name:        "ng case explicit",
+			partitioner: "explicit",
+			reqs:        []*api.ProduceRequest{keyed("a")},
+			err:         api.ErrPartitionRequired{Topic: "orders"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParsePartitioner(tt.partitioner)
+			require.NoError(t, err)
+			var got []uint32
+			for _, req := range tt.reqs {
+				partition, err := p.Partition(req, 3)
+				if err != nil {
+					require.Equal(t, tt.err, err)
+					return
+				}
+				got = append(got, partition)
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := ParsePartitioner("random")
+	require.Error(t, err)
+}
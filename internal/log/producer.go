@@ -0,0 +1,57 @@
+package log
+
+import (
+	api "github.com/chmikata/proglog/api/v1"
+)
+
+// producerWindow is how many of its latest sequence numbers are remembered
+// for each producer. A retry of anything older can't be deduplicated.
+const producerWindow = 5
+
+// producerState remembers where the latest records of an idempotent
+// producer were appended, so a resent record is acknowledged instead of
+// appended again.
+type producerState struct {
+	id     uint64
+	recent []*api.SequencedOffset
+	// lastIndex is the index of the Raft entry that last used the
+	// producer, which decides when it expires.
+	lastIndex uint64
+}
+
+// appended returns where the record with seq was appended. ok is false for
+// the sequence number the producer should send next, and anything past it
+// is a gap.
+func (p *producerState) appended(seq uint64) (r *api.SequencedOffset, ok bool, err error) {
+	var last uint64
+	if len(p.recent) != 0 {
+		last = p.recent[len(p.recent)-1].Sequence
+	}
+	if seq == last+1 {
+		return nil, false, nil
+	}
+	if seq > last {
+		return nil, false, api.ErrSequenceGap{
+			ProducerID: p.id,
+			Sequence:   seq,
+			Last:       last,
+		}
+	}
+	for _, r := range p.recent {
+		if r.Sequence == seq {
+			return r, true, nil
+		}
+	}
+	return nil, false, api.ErrStaleSequence{
+		ProducerID: p.id,
+		Sequence:   seq,
+		Last:       last,
+	}
+}
+
+func (p *producerState) append(r *api.SequencedOffset) {
+	p.recent = append(p.recent, r)
+	if len(p.recent) > producerWindow {
+		p.recent = p.recent[len(p.recent)-producerWindow:]
+	}
+}
@@ -2,19 +2,36 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	api "github.com/chmikata/proglog/api/v1"
+	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 )
 
 type segment struct {
 	store      *store
 	index      *index
+	timeIndex  *index
 	baseOffset uint64
 	nextOffset uint64
 	config     Config
+
+	maxTimestamp  int64
+	timeIndexedAt uint64
+
+	// sums caches the checksums of the segment once it is closed.
+	sums *api.SegmentManifest
+
+	// block caches the records of the block of a compressed segment read
+	// last, at blockPos, since reads mostly go through a block in order.
+	blockMu  sync.Mutex
+	blockPos uint64
+	block    []*api.Record
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
@@ -33,6 +50,11 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.store, err = newStore(storeFile); err != nil {
 		return nil, err
 	}
+	if s.store.size == 0 && c.Compression.Codec != CodecNone {
+		if err := s.store.writeHeader(c.Compression.Codec); err != nil {
+			return nil, err
+		}
+	}
 
 	indexFile, err := os.OpenFile(
 		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
@@ -46,47 +68,412 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	s.readNextOffset()
+
+	timeIndexFile, err := os.OpenFile(
+		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex")),
+		os.O_RDWR|os.O_CREATE,
+		0600,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if s.timeIndex, err = newIndex(timeIndexFile, c); err != nil {
+		return nil, err
+	}
+	if err := s.loadTimeIndex(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *segment) readNextOffset() {
 	if off, _, err := s.index.Read(-1); err != nil {
-		s.nextOffset = baseOffset
+		s.nextOffset = s.baseOffset
 	} else {
-		s.nextOffset = baseOffset + uint64(off) + 1
+		s.nextOffset = s.baseOffset + uint64(off) + 1
 	}
-	return s, nil
 }
 
 func (s *segment) Append(record *api.Record) (uint64, error) {
 	cur := s.nextOffset
 	record.Offset = cur
+	if err := s.write(record); err != nil {
+		return 0, err
+	}
+	return cur, nil
+}
+
+// write stores record under the offset it already carries, which may be
+// past nextOffset when the records in between were compacted away.
+func (s *segment) write(record *api.Record) error {
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
 	p, err := proto.Marshal(record)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	_, pos, err := s.store.Append(p)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	if err := s.index.Write(
-		uint32(s.nextOffset-uint64(s.baseOffset)),
+		uint32(record.Offset-s.baseOffset),
 		pos,
 	); err != nil {
-		return 0, err
+		return err
 	}
-	s.nextOffset++
-	return cur, nil
+	s.indexTime(record.Timestamp, record.Offset, pos)
+	s.nextOffset = record.Offset + 1
+	return nil
+}
+
+// writeRecords stores records as write does. A compressed segment packs
+// them into blocks of about blockBytes, each compressed as one record of
+// the store, and indexes every record at the position of its block.
+func (s *segment) writeRecords(records []*api.Record) error {
+	if s.store.codec == CodecNone {
+		for _, record := range records {
+			if err := s.write(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var (
+		block []byte
+		first int
+	)
+	for i, record := range records {
+		p, err := proto.Marshal(record)
+		if err != nil {
+			return err
+		}
+		block = appendFrame(block, p)
+		if len(block) < blockBytes && i < len(records)-1 {
+			continue
+		}
+		if err := s.writeBlock(block, records[first:i+1]); err != nil {
+			return err
+		}
+		block, first = block[:0], i+1
+	}
+	return nil
+}
+
+func (s *segment) writeBlock(block []byte, records []*api.Record) error {
+	p, err := s.store.codec.compress(block)
+	if err != nil {
+		return err
+	}
+	_, pos, err := s.store.Append(p)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := s.index.Write(
+			uint32(record.Offset-s.baseOffset),
+			pos,
+		); err != nil {
+			return err
+		}
+		s.indexTime(record.Timestamp, record.Offset, pos)
+		s.nextOffset = record.Offset + 1
+	}
+	return nil
+}
+
+// segmentMark is the state of a segment at a point it can be rolled back to.
+type segmentMark struct {
+	storeSize     uint64
+	indexSize     uint64
+	timeIndexSize uint64
+	nextOffset    uint64
+	maxTimestamp  int64
+	timeIndexedAt uint64
+}
+
+func (s *segment) mark() segmentMark {
+	return segmentMark{
+		storeSize:     s.store.size,
+		indexSize:     s.index.size,
+		timeIndexSize: s.timeIndex.size,
+		nextOffset:    s.nextOffset,
+		maxTimestamp:  s.maxTimestamp,
+		timeIndexedAt: s.timeIndexedAt,
+	}
+}
+
+// rollback discards everything appended since m was taken.
+func (s *segment) rollback(m segmentMark) error {
+	if err := s.store.Truncate(m.storeSize); err != nil {
+		return err
+	}
+	s.index.size = m.indexSize
+	s.timeIndex.size = m.timeIndexSize
+	s.nextOffset = m.nextOffset
+	s.maxTimestamp = m.maxTimestamp
+	s.timeIndexedAt = m.timeIndexedAt
+	return nil
+}
+
+// truncate removes the records at from and after it from the segment.
+// Compressed segments are only ever removed whole.
+func (s *segment) truncate(from uint64) error {
+	if from >= s.nextOffset {
+		return nil
+	}
+	if s.store.codec != CodecNone {
+		return fmt.Errorf("truncate compressed segment %d", s.baseOffset)
+	}
+	var i int64
+	if from > s.baseOffset {
+		i = s.index.Search(uint32(from - s.baseOffset))
+	}
+	_, pos, err := s.index.Read(i)
+	if err == io.EOF {
+		// from falls in a gap after the last record
+		pos = s.store.size
+	} else if err != nil {
+		return err
+	}
+	if err := s.store.Truncate(pos); err != nil {
+		return err
+	}
+	s.index.size = uint64(i) * entWidth
+	s.sums = nil
+	s.readNextOffset()
+	return s.loadTimeIndex()
 }
 
 func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	i, err := s.entry(off)
+	if err != nil {
+		return nil, err
+	}
+	return s.readEntry(i)
+}
+
+// entry returns the position in the index of the entry for off. Entries
+// sit at their relative offset unless the segment has been compacted, in
+// which case they are searched for.
+func (s *segment) entry(off uint64) (int64, error) {
+	rel := uint32(off - s.baseOffset)
+	if got, _, err := s.index.Read(int64(rel)); err == nil && got == rel {
+		return int64(rel), nil
+	}
+	i := s.index.Search(rel)
+	got, _, err := s.index.Read(i)
+	if err == io.EOF && off < s.nextOffset {
+		return 0, api.ErrOffsetCompacted{Offset: off}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if got != rel {
+		return 0, api.ErrOffsetCompacted{Offset: off}
+	}
+	return i, nil
+}
+
+func (s *segment) readEntry(i int64) (*api.Record, error) {
+	off, pos, err := s.index.Read(i)
 	if err != nil {
 		return nil, err
 	}
+	if s.store.codec != CodecNone {
+		return s.readBlockEntry(pos, s.baseOffset+uint64(off))
+	}
 	p, err := s.store.Read(pos)
 	if err != nil {
 		return nil, err
 	}
 	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	if err := proto.Unmarshal(p, record); err != nil {
+		return nil, api.ErrCorruptRecord{Path: s.store.Name(), Pos: pos}
+	}
+	return record, nil
+}
+
+// readBlockEntry returns the record at off from the block at pos.
+func (s *segment) readBlockEntry(pos, off uint64) (*api.Record, error) {
+	records, err := s.readBlock(pos)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if record.Offset == off {
+			return proto.Clone(record).(*api.Record), nil
+		}
+	}
+	return nil, api.ErrCorruptRecord{Path: s.store.Name(), Pos: pos}
+}
+
+// readBlock returns the records of the block at pos.
+func (s *segment) readBlock(pos uint64) ([]*api.Record, error) {
+	s.blockMu.Lock()
+	defer s.blockMu.Unlock()
+	if s.block != nil && s.blockPos == pos {
+		return s.block, nil
+	}
+	p, err := s.store.Read(pos)
+	if err != nil {
+		return nil, err
+	}
+	corrupt := api.ErrCorruptRecord{Path: s.store.Name(), Pos: pos}
+	p, err = s.store.codec.decompress(p)
+	if err != nil {
+		return nil, corrupt
+	}
+	frames, err := splitFrames(p)
+	if err != nil {
+		return nil, corrupt
+	}
+	records := make([]*api.Record, len(frames))
+	for i, frame := range frames {
+		records[i] = &api.Record{}
+		if err := proto.Unmarshal(frame, records[i]); err != nil {
+			return nil, corrupt
+		}
+	}
+	s.blockPos, s.block = pos, records
+	return records, nil
+}
+
+// recover brings the index back in line with the store after an unclean
+// shutdown or when the index is missing.
+func (s *segment) recover() error {
+	if ok, err := s.consistent(); err != nil || ok {
+		return err
+	}
+	return s.reindex()
+}
+
+// reindex rebuilds the index from the records in the store. A partial
+// trailing record is dropped from the store, index entries that don't match
+// a stored record are discarded and entries for records the index is
+// missing are written.
+func (s *segment) reindex() error {
+	positions, end, err := s.store.scan()
+	if err != nil {
+		return err
+	}
+	dropped := s.store.size - end
+	if dropped > 0 {
+		if err := s.store.Truncate(end); err != nil {
+			return err
+		}
+	}
+	offsets, positions := s.relativeOffsets(positions)
+	entries := s.index.size / entWidth
+	if limit := uint64(len(s.index.mmap)) / entWidth; entries > limit {
+		entries = limit
+	}
+	var kept uint64
+	for kept < entries && kept < uint64(len(positions)) {
+		off, pos, err := s.index.Read(int64(kept))
+		if err != nil || off != offsets[kept] || pos != positions[kept] {
+			break
+		}
+		kept++
+	}
+	s.index.size = kept * entWidth
+	s.sums = nil
+	for i := kept; i < uint64(len(positions)); i++ {
+		if err := s.index.Write(offsets[i], positions[i]); err != nil {
+			return err
+		}
+	}
+	zap.L().Named("segment").Info(
+		"reindexed segment",
+		zap.String("store", s.store.Name()),
+		zap.Uint64("dropped_bytes", dropped),
+		zap.Uint64("dropped_entries", entries-kept),
+		zap.Int("rebuilt_entries", len(positions)-int(kept)),
+	)
+	return nil
+}
+
+// relativeOffsets reads the offset each record was written under, so that
+// gaps left by compaction survive a rebuild. A record that can't be decoded
+// is assumed to follow the previous one. The records of a compressed
+// segment are returned with the position of their block, and blocks that
+// can't be decoded are skipped.
+func (s *segment) relativeOffsets(positions []uint64) ([]uint32, []uint64) {
+	if s.store.codec != CodecNone {
+		var (
+			offsets []uint32
+			entries []uint64
+		)
+		for _, pos := range positions {
+			records, err := s.readBlock(pos)
+			if err != nil {
+				continue
+			}
+			for _, record := range records {
+				offsets = append(offsets, uint32(record.Offset-s.baseOffset))
+				entries = append(entries, pos)
+			}
+		}
+		return offsets, entries
+	}
+	offsets := make([]uint32, len(positions))
+	for i, pos := range positions {
+		next := uint32(i)
+		if i > 0 {
+			next = offsets[i-1] + 1
+		}
+		offsets[i] = next
+		p, err := s.store.Read(pos)
+		if err != nil {
+			continue
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil ||
+			record.Offset < s.baseOffset+uint64(next) {
+			continue
+		}
+		offsets[i] = uint32(record.Offset - s.baseOffset)
+	}
+	return offsets, positions
+}
+
+// consistent reports whether the offsets in the index increase and its
+// positions are those of the records in the store, in order and up to the
+// last one, which holds for every cleanly closed segment. The records of a
+// compressed block share a position.
+func (s *segment) consistent() (bool, error) {
+	if s.index.size%entWidth != 0 ||
+		s.index.size > uint64(len(s.index.mmap)) {
+		return false, nil
+	}
+	positions, end, err := s.store.scan()
+	if err != nil || end != s.store.size {
+		return false, err
+	}
+	var (
+		lastOff int64 = -1
+		next    int
+	)
+	for i := int64(0); i < int64(s.index.size/entWidth); i++ {
+		off, pos, err := s.index.Read(i)
+		if err != nil || int64(off) <= lastOff {
+			return false, nil
+		}
+		lastOff = int64(off)
+		if next > 0 && pos == positions[next-1] && s.store.codec != CodecNone {
+			continue
+		}
+		if next == len(positions) || pos != positions[next] {
+			return false, nil
+		}
+		next++
+	}
+	return next == len(positions), nil
 }
 
 func (s *segment) IsMaxed() bool {
@@ -95,6 +482,17 @@ func (s *segment) IsMaxed() bool {
 		s.index.isMaxed()
 }
 
+// Sync commits the store and both indexes to disk.
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	return s.timeIndex.Sync()
+}
+
 func (s *segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
@@ -102,6 +500,9 @@ func (s *segment) Remove() error {
 	if err := os.Remove(s.index.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
@@ -112,6 +513,9 @@ func (s *segment) Close() error {
 	if err := s.index.Close(); err != nil {
 		return err
 	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
 	if err := s.store.Close(); err != nil {
 		return err
 	}
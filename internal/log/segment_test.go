@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"testing"
+	"time"
 
 	api "github.com/chmikata/proglog/api/v1"
 	"github.com/stretchr/testify/assert"
@@ -23,12 +24,15 @@ func Test_newSegment(t *testing.T) {
 		os.Remove(fi.Name())
 		os.Remove(fmt.Sprintf("%s/%d.store", dir, baseOffset))
 		os.Remove(fmt.Sprintf("%s/%d.index", dir, baseOffset))
+		os.Remove(fmt.Sprintf("%s/%d.timeindex", dir, baseOffset))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 100,
 			MaxIndexBytes: 100,
@@ -90,12 +94,15 @@ func Test_segment_Append(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/%d.store", dir, baseOffset))
 		os.Remove(fmt.Sprintf("%s/%d.index", dir, baseOffset))
+		os.Remove(fmt.Sprintf("%s/%d.timeindex", dir, baseOffset))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 100,
 			MaxIndexBytes: 24,
@@ -162,12 +169,15 @@ func Test_segment_Read(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/%d.store", dir, baseOffset))
 		os.Remove(fmt.Sprintf("%s/%d.index", dir, baseOffset))
+		os.Remove(fmt.Sprintf("%s/%d.timeindex", dir, baseOffset))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 100,
 			MaxIndexBytes: 24,
@@ -195,12 +205,12 @@ func Test_segment_Read(t *testing.T) {
 				return assert.NoError(tt, err)
 			},
 			setup: func(tst *test) {
-				rec := &api.Record{Value: []byte("hello world")}
+				rec := &api.Record{Value: []byte("hello world"), Timestamp: 1}
 				rec.Offset = tst.segment.nextOffset
 				p, _ := proto.Marshal(rec)
 				proto.Unmarshal(p, rec)
 				tst.want = rec
-				addrec := &api.Record{Value: []byte("hello world")}
+				addrec := &api.Record{Value: []byte("hello world"), Timestamp: 1}
 				tst.segment.Append(addrec)
 			},
 		},
@@ -241,12 +251,15 @@ func Test_segment_IsMaxed(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/%d.store", dir, baseOffset))
 		os.Remove(fmt.Sprintf("%s/%d.index", dir, baseOffset))
+		os.Remove(fmt.Sprintf("%s/%d.timeindex", dir, baseOffset))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 100,
 			MaxIndexBytes: 12,
@@ -295,6 +308,8 @@ func Test_segment_Remove(t *testing.T) {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 100,
 			MaxIndexBytes: 12,
@@ -341,12 +356,15 @@ func Test_segment_Close(t *testing.T) {
 	t.Cleanup(func() {
 		os.Remove(fmt.Sprintf("%s/%d.store", dir, baseOffset))
 		os.Remove(fmt.Sprintf("%s/%d.index", dir, baseOffset))
+		os.Remove(fmt.Sprintf("%s/%d.timeindex", dir, baseOffset))
 	})
 	c := Config{
 		Segment: struct {
 			MaxStoreBytes uint64
 			MaxIndexBytes uint64
 			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
 		}{
 			MaxStoreBytes: 100,
 			MaxIndexBytes: 100,
@@ -392,3 +410,122 @@ func Test_segment_Close(t *testing.T) {
 		})
 	}
 }
+
+func Test_segment_recover(t *testing.T) {
+	t.Parallel()
+
+	c := Config{
+		Segment: struct {
+			MaxStoreBytes uint64
+			MaxIndexBytes uint64
+			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
+		}{
+			MaxStoreBytes: 1024,
+			MaxIndexBytes: 120,
+			InitialOffset: 0,
+		},
+	}
+	type test struct {
+		name  string
+		want  uint64
+		crash func(store, index string)
+	}
+	tests := []test{
+		{
+			name:  "ok clean case",
+			want:  63,
+			crash: func(_, _ string) {},
+		},
+		{
+			name: "ok partial trailing record case",
+			want: 63,
+			crash: func(store, _ string) {
+				f, _ := os.OpenFile(store, os.O_WRONLY|os.O_APPEND, 0600)
+				f.Write([]byte{0, 0, 0})
+				f.Close()
+			},
+		},
+		{
+			name: "ok index past store end case",
+			want: 62,
+			crash: func(store, _ string) {
+				fi, _ := os.Stat(store)
+				os.Truncate(store, fi.Size()-5)
+			},
+		},
+		{
+			name: "ok index missing entries case",
+			want: 63,
+			crash: func(_, index string) {
+				os.Truncate(index, int64(entWidth))
+			},
+		},
+		{
+			name: "ok index damaged before last entry case",
+			want: 63,
+			crash: func(_, index string) {
+				f, _ := os.OpenFile(index, os.O_WRONLY, 0600)
+				b := make([]byte, posWidth)
+				enc.PutUint64(b, 1<<40)
+				f.WriteAt(b, int64(entWidth+offWidth))
+				f.Close()
+			},
+		},
+		{
+			name: "ok index position mid record case",
+			want: 63,
+			crash: func(_, index string) {
+				f, _ := os.OpenFile(index, os.O_RDWR, 0600)
+				b := make([]byte, posWidth)
+				f.ReadAt(b, int64(entWidth+offWidth))
+				enc.PutUint64(b, enc.Uint64(b)+lenWidth)
+				f.WriteAt(b, int64(entWidth+offWidth))
+				f.Close()
+			},
+		},
+		{
+			name: "ok index missing case",
+			want: 63,
+			crash: func(_, index string) {
+				os.Remove(index)
+			},
+		},
+		{
+			name: "ok index left unsynced case",
+			want: 63,
+			crash: func(_, index string) {
+				os.Truncate(index, int64(c.Segment.MaxIndexBytes))
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir, _ := os.MkdirTemp("", "Test_segment_recover")
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			seg, _ := newSegment(dir, 60, c)
+			for i := 0; i < 4; i++ {
+				seg.Append(&api.Record{Value: []byte("hello world")})
+			}
+			seg.Close()
+			tt.crash(seg.store.Name(), seg.index.Name())
+
+			got, err := newSegment(dir, 60, c)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want+1, got.nextOffset)
+			for off := uint64(60); off <= tt.want; off++ {
+				record, err := got.Read(off)
+				if assert.NoError(t, err) {
+					assert.Equal(t, off, record.Offset)
+				}
+			}
+			off, err := got.Append(&api.Record{Value: []byte("hello world")})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want+1, off)
+		})
+	}
+}
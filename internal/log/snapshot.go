@@ -0,0 +1,540 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	api "github.com/chmikata/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// installDir is the directory, inside the log directory, that the
+	// segments of a snapshot are fetched into before they are installed.
+	installDir = ".install"
+
+	// replacedDir holds the segments a snapshot replaces until all of its
+	// segments are in place.
+	replacedDir = ".replaced"
+
+	// keptSnapshots is how many of the latest snapshots keep their segments
+	// pinned. Raft retains one snapshot; the one before stays fetchable for
+	// followers still restoring it.
+	keptSnapshots = 2
+
+	// fetchTimeout bounds how long fetching a segment waits for the next
+	// bytes.
+	fetchTimeout = 10 * time.Second
+)
+
+// checksums describes the files of a closed segment. The checksums are
+// computed once, as closed segments don't change until they are replaced.
+func (s *segment) checksums() (*api.SegmentManifest, error) {
+	if s.sums != nil {
+		return s.sums, nil
+	}
+	sums, err := s.manifest()
+	if err != nil {
+		return nil, err
+	}
+	s.sums = sums
+	return sums, nil
+}
+
+// manifest describes the store and index of the segment as they are now.
+func (s *segment) manifest() (*api.SegmentManifest, error) {
+	h := crc32.New(crcTable)
+	if _, err := io.Copy(h, io.NewSectionReader(s.store, 0, int64(s.store.size))); err != nil {
+		return nil, err
+	}
+	return &api.SegmentManifest{
+		BaseOffset: s.baseOffset,
+		StoreBytes: s.store.size,
+		StoreCrc:   h.Sum32(),
+		IndexBytes: s.index.size,
+		IndexCrc:   crc32.Checksum(s.index.mmap[:s.index.size], crcTable),
+	}, nil
+}
+
+// pin links the store and index files of every segment holding records
+// into dir, so they stay as they are whatever compaction or retention
+// later does to the log, and returns the manifest of the pinned segments.
+// The active segment keeps taking appends; only the bytes it holds now
+// are part of the snapshot, as appends never change them.
+func (l *Log) pin(dir string) (*api.LogManifest, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	m := &api.LogManifest{NextOffset: l.activeSegment.nextOffset}
+	for _, s := range l.segments {
+		if s == l.activeSegment && s.store.size == 0 {
+			break
+		}
+		if err := s.Sync(); err != nil {
+			return nil, err
+		}
+		var (
+			sums *api.SegmentManifest
+			err  error
+		)
+		if s == l.activeSegment {
+			sums, err = s.manifest()
+		} else {
+			sums, err = s.checksums()
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range []string{s.store.Name(), s.index.Name()} {
+			if err := os.Link(name, filepath.Join(dir, filepath.Base(name))); err != nil {
+				return nil, err
+			}
+		}
+		m.Segments = append(m.Segments, sums)
+		m.Active = s == l.activeSegment
+	}
+	return m, syncDir(dir)
+}
+
+// install replaces the segments of the log with those in m. Segments the
+// log already holds with the same checksums are kept; fetch writes the
+// files of the others, as they are, into the directory it is given. The
+// records are never decoded, apart from rebuilding the time index of the
+// fetched segments. The segments replaced are only removed
+// once all of the fetched ones are in place, and are put back otherwise.
+func (l *Log) install(
+	m *api.LogManifest,
+	fetch func(seg *api.SegmentManifest, dir string) error,
+) error {
+	l.stop()
+	defer l.start()
+
+	l.mu.RLock()
+	local := make(map[uint64]*api.SegmentManifest)
+	for _, s := range l.segments {
+		var (
+			sums *api.SegmentManifest
+			err  error
+		)
+		if s == l.activeSegment {
+			sums, err = s.manifest()
+		} else {
+			sums, err = s.checksums()
+		}
+		if err != nil {
+			l.mu.RUnlock()
+			return err
+		}
+		local[s.baseOffset] = sums
+	}
+	l.mu.RUnlock()
+
+	dir := filepath.Join(l.Dir, installDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0777); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	keep := make(map[uint64]bool)
+	fetched := 0
+	for _, seg := range m.Segments {
+		if sums, ok := local[seg.BaseOffset]; ok && proto.Equal(sums, seg) {
+			keep[seg.BaseOffset] = true
+			continue
+		}
+		if err := fetch(seg, dir); err != nil {
+			return fmt.Errorf("fetch segment %d: %w", seg.BaseOffset, err)
+		}
+		fetched++
+	}
+
+	// The segments end where they did on the node that took the snapshot,
+	// so that retention and compaction drop the same records here.
+	if !m.Active {
+		c := l.Config
+		c.Compression.Codec = CodecNone
+		active, err := newSegment(dir, m.NextOffset, c)
+		if err != nil {
+			return err
+		}
+		if err := active.Close(); err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var replaced []string
+	for _, s := range l.segments {
+		if err := s.Close(); err != nil {
+			return err
+		}
+		if !keep[s.baseOffset] {
+			replaced = append(replaced, s.store.Name(), s.index.Name(), s.timeIndex.Name())
+		}
+	}
+	l.segments, l.activeSegment = nil, nil
+	if err := l.swap(dir, replaced); err != nil {
+		if oerr := l.openSegments(); oerr != nil {
+			return fmt.Errorf("%w; reopen segments: %v", err, oerr)
+		}
+		return err
+	}
+	zap.L().Named("log").Info(
+		"installed snapshot segments",
+		zap.String("dir", l.Dir),
+		zap.Int("kept_segments", len(keep)),
+		zap.Int("fetched_segments", fetched),
+	)
+	return l.openSegments()
+}
+
+// swap moves the files replaced out of the log directory and every file
+// in dir into it. If any of them can't be moved, the files already moved
+// are moved back.
+func (l *Log) swap(dir string, replaced []string) error {
+	old := filepath.Join(l.Dir, replacedDir)
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Mkdir(old, 0777); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var moved [][2]string
+	move := func(from, to string) error {
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+		moved = append(moved, [2]string{from, to})
+		return nil
+	}
+	err = func() error {
+		for _, name := range replaced {
+			if err := move(name, filepath.Join(old, filepath.Base(name))); err != nil {
+				return err
+			}
+		}
+		for _, file := range files {
+			name := file.Name()
+			if err := move(filepath.Join(dir, name), filepath.Join(l.Dir, name)); err != nil {
+				return err
+			}
+		}
+		return syncDir(l.Dir)
+	}()
+	if err != nil {
+		for i := len(moved) - 1; i >= 0; i-- {
+			if rerr := os.Rename(moved[i][1], moved[i][0]); rerr != nil {
+				return fmt.Errorf("%w; restore %s: %v", err, moved[i][0], rerr)
+			}
+		}
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// pinDir returns the directory the segments of a partition are pinned in
+// for the snapshot id.
+func (f *fsm) pinDir(id string, p partitionID) (string, error) {
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return "", fmt.Errorf("invalid snapshot id: %q", id)
+	}
+	if p.topic == "" {
+		return filepath.Join(f.segments, id, "log"), nil
+	}
+	if !topicName.MatchString(p.topic) || p.topic == "." || p.topic == ".." {
+		return "", api.ErrInvalidTopicName{Topic: p.topic}
+	}
+	return filepath.Join(
+		f.segments, id, "topics", p.topic,
+		strconv.FormatUint(uint64(p.partition), 10),
+	), nil
+}
+
+// pin pins the segments of the default log and of every partition of
+// topics for the snapshot id.
+func (f *fsm) pin(id string, topics []*api.Topic) (*api.SnapshotManifest, error) {
+	m := &api.SnapshotManifest{Id: id, SourceAddr: f.addr}
+	ids := []partitionID{{}}
+	for _, topic := range topics {
+		for p := uint32(0); p < partitionCount(topic.Config); p++ {
+			ids = append(ids, partitionID{topic.Name, p})
+		}
+	}
+	for _, p := range ids {
+		log, err := f.partitionLog(p)
+		if err != nil {
+			return nil, err
+		}
+		dir, err := f.pinDir(id, p)
+		if err != nil {
+			return nil, err
+		}
+		lm, err := log.pin(dir)
+		if err != nil {
+			return nil, err
+		}
+		lm.Topic, lm.Partition = p.topic, p.partition
+		m.Logs = append(m.Logs, lm)
+	}
+	return m, f.prune()
+}
+
+// prune removes the pinned segments of all but the keptSnapshots latest
+// snapshots.
+func (f *fsm) prune() error {
+	entries, err := os.ReadDir(f.segments)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var ids []uint64
+	for _, entry := range entries {
+		if id, err := strconv.ParseUint(entry.Name(), 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	for i := keptSnapshots; i < len(ids); i++ {
+		dir := filepath.Join(f.segments, strconv.FormatUint(ids[i], 10))
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// install installs the segments of every log in m.
+func (f *fsm) install(m *api.SnapshotManifest) error {
+	_, err := os.Stat(filepath.Join(f.segments, m.Id))
+	pinned := err == nil
+	for _, lm := range m.Logs {
+		p := partitionID{lm.Topic, lm.Partition}
+		log, err := f.partitionLog(p)
+		if err != nil {
+			return err
+		}
+		dir, err := f.pinDir(m.Id, p)
+		if err != nil {
+			return err
+		}
+		if err := log.install(lm, func(seg *api.SegmentManifest, dst string) error {
+			return f.fetchSegment(m, p, seg, dst)
+		}); err != nil {
+			return err
+		}
+		if pinned {
+			continue
+		}
+		// Pin what was installed so a restart can restore it again.
+		if _, err := log.pin(dir); err != nil {
+			return err
+		}
+	}
+	if pinned {
+		return nil
+	}
+	return f.prune()
+}
+
+// fetchSegment writes the files of a segment of the snapshot m into dir.
+// They are copied from this node's own pin of the snapshot if it has one,
+// and fetched from the node that took the snapshot otherwise.
+func (f *fsm) fetchSegment(
+	m *api.SnapshotManifest,
+	p partitionID,
+	seg *api.SegmentManifest,
+	dir string,
+) error {
+	src, err := f.pinDir(m.Id, p)
+	if err != nil {
+		return err
+	}
+	r, err := openPinned(src, seg)
+	if err == nil {
+		defer r.Close()
+		return writeSegment(r, seg, dir)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if m.SourceAddr == "" || m.SourceAddr == f.addr || f.dial == nil {
+		return err
+	}
+	conn, err := f.dial(m.SourceAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	b, err := proto.Marshal(&api.FetchSegmentRequest{
+		SnapshotId: m.Id,
+		Topic:      p.topic,
+		Partition:  p.partition,
+		Segment:    seg,
+	})
+	if err != nil {
+		return err
+	}
+	req := make([]byte, lenWidth, lenWidth+len(b))
+	enc.PutUint64(req, encodeLen(b))
+	if _, err := conn.Write(append(req, b...)); err != nil {
+		return err
+	}
+	return writeSegment(&idleReader{conn}, seg, dir)
+}
+
+// serveSegment sends the files of the pinned segment requested over conn
+// and closes it.
+func (f *fsm) serveSegment(conn net.Conn) {
+	defer conn.Close()
+	err := func() error {
+		if err := conn.SetReadDeadline(time.Now().Add(fetchTimeout)); err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if _, err := readSnapshotEntry(conn, make([]byte, lenWidth), &buf); err != nil {
+			return err
+		}
+		req := &api.FetchSegmentRequest{}
+		if err := proto.Unmarshal(buf.Bytes(), req); err != nil {
+			return err
+		}
+		if req.Segment == nil {
+			return fmt.Errorf("no segment requested")
+		}
+		dir, err := f.pinDir(req.SnapshotId, partitionID{req.Topic, req.Partition})
+		if err != nil {
+			return err
+		}
+		r, err := openPinned(dir, req.Segment)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(conn, r)
+		return err
+	}()
+	if err != nil {
+		zap.L().Named("log").Error(
+			"failed to serve segment",
+			zap.Error(err),
+			zap.Stringer("remote", conn.RemoteAddr()),
+		)
+	}
+}
+
+// pinnedReader reads the store bytes of a pinned segment followed by its
+// index bytes.
+type pinnedReader struct {
+	io.Reader
+	files []*os.File
+}
+
+func openPinned(dir string, seg *api.SegmentManifest) (*pinnedReader, error) {
+	r := &pinnedReader{}
+	var readers []io.Reader
+	for _, f := range []struct {
+		ext  string
+		size uint64
+	}{
+		{".store", seg.StoreBytes},
+		{".index", seg.IndexBytes},
+	} {
+		file, err := os.Open(filepath.Join(dir, fmt.Sprintf("%d%s", seg.BaseOffset, f.ext)))
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.files = append(r.files, file)
+		readers = append(readers, io.LimitReader(file, int64(f.size)))
+	}
+	r.Reader = io.MultiReader(readers...)
+	return r, nil
+}
+
+func (r *pinnedReader) Close() error {
+	var err error
+	for _, file := range r.files {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// writeSegment writes the store and index files of seg into dir from r,
+// checking them against the checksums of seg.
+func writeSegment(r io.Reader, seg *api.SegmentManifest, dir string) error {
+	for _, f := range []struct {
+		ext  string
+		size uint64
+		sum  uint32
+	}{
+		{".store", seg.StoreBytes, seg.StoreCrc},
+		{".index", seg.IndexBytes, seg.IndexCrc},
+	} {
+		name := filepath.Join(dir, fmt.Sprintf("%d%s", seg.BaseOffset, f.ext))
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		h := crc32.New(crcTable)
+		_, err = io.CopyN(io.MultiWriter(file, h), r, int64(f.size))
+		if err == nil {
+			err = file.Sync()
+		}
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if h.Sum32() != f.sum {
+			return fmt.Errorf("%s: checksum mismatch", filepath.Base(name))
+		}
+	}
+	return nil
+}
+
+// idleReader fails a read of conn that receives nothing for fetchTimeout.
+type idleReader struct {
+	conn net.Conn
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	if err := r.conn.SetReadDeadline(time.Now().Add(fetchTimeout)); err != nil {
+		return 0, err
+	}
+	return r.conn.Read(p)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
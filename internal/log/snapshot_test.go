@@ -0,0 +1,330 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/chmikata/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+type testSink struct {
+	bytes.Buffer
+}
+
+func (s *testSink) ID() string    { return "test" }
+func (s *testSink) Cancel() error { return nil }
+func (s *testSink) Close() error  { return nil }
+
+var _ raft.SnapshotSink = (*testSink)(nil)
+
+func newTestFSM(t *testing.T, addr string) *fsm {
+	dir, err := os.MkdirTemp("", "TestFSM")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	log, err := NewLog(filepath.Join(dir, "log"), Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { log.Close() })
+	topics, err := newTopics(filepath.Join(dir, "topics"), Config{}, true)
+	require.NoError(t, err)
+	t.Cleanup(func() { topics.Close() })
+	return &fsm{
+		log:       log,
+		topics:    topics,
+		offsets:   map[string]uint64{},
+		producers: map[uint64]*producerState{},
+		keys:      map[partitionID]map[string]uint64{},
+		segments:  filepath.Join(dir, "segments"),
+		addr:      addr,
+	}
+}
+
+// serveFrom makes f fetch segments from src over an in-memory connection
+// and returns the number of segments fetched so far.
+func serveFrom(t *testing.T, f, src *fsm) func() int {
+	fetched := 0
+	f.dial = func(addr string) (net.Conn, error) {
+		require.Equal(t, src.addr, addr)
+		fetched++
+		client, server := net.Pipe()
+		go src.serveSegment(server)
+		return client, nil
+	}
+	return func() int { return fetched }
+}
+
+func TestFSM_SnapshotRestore(t *testing.T) {
+	src := newTestFSM(t, "src")
+	for _, v := range []string{"first", "second"} {
+		_, err := src.log.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+	src.offsets["orders"] = 2
+	src.offsets["billing"] = 1
+	src.nextProducerID = 1
+	src.producers[1] = &producerState{id: 1}
+	src.producers[1].append(&api.SequencedOffset{Sequence: 2, Offset: 1})
+	require.NoError(t, src.topics.Create("events", &api.TopicConfig{
+		MaxIndexBytes: 24,
+		Partitions:    2,
+	}))
+	events, err := src.topics.Get("events", 0)
+	require.NoError(t, err)
+	for _, v := range []string{"created", "updated", "deleted"} {
+		_, err := events.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+	archived, err := src.topics.Get("events", 1)
+	require.NoError(t, err)
+	_, err = archived.Append(&api.Record{Value: []byte("archived")})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		persist   func(*testSink) error
+		offsets   map[string]uint64
+		producers int
+		topics    int
+	}{
+		{
+			name: "ok case with state",
+			persist: func(sink *testSink) error {
+				snap, err := src.Snapshot()
+				if err != nil {
+					return err
+				}
+				return snap.Persist(sink)
+			},
+			offsets:   map[string]uint64{"orders": 2, "billing": 1},
+			producers: 1,
+			topics:    1,
+		},
+		{
+			name: "ok case sections",
+			persist: func(sink *testSink) error {
+				// The format from when snapshots carried the records.
+				b, err := proto.Marshal(src.state())
+				if err != nil {
+					return err
+				}
+				readers := []io.Reader{
+					bytes.NewReader(snapshotSection(b)),
+					src.log.Reader(),
+				}
+				for p := uint32(0); p < 2; p++ {
+					log, err := src.topics.Get("events", p)
+					if err != nil {
+						return err
+					}
+					section := fmt.Sprintf("events/%d", p)
+					readers = append(readers,
+						bytes.NewReader(snapshotSection([]byte(section))),
+						log.Reader(),
+					)
+				}
+				_, err = io.Copy(sink, io.MultiReader(readers...))
+				return err
+			},
+			offsets:   map[string]uint64{"orders": 2, "billing": 1},
+			producers: 1,
+			topics:    1,
+		},
+		{
+			name: "ok case records only",
+			persist: func(sink *testSink) error {
+				_, err := io.Copy(sink, src.log.Reader())
+				return err
+			},
+			offsets: map[string]uint64{},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &testSink{}
+			require.NoError(t, tt.persist(sink))
+
+			dst := newTestFSM(t, "dst")
+			serveFrom(t, dst, src)
+			dst.offsets["stale"] = 9
+			require.NoError(t, dst.topics.Create("stale", nil))
+			require.NoError(t, dst.Restore(io.NopCloser(sink)))
+			require.Equal(t, tt.offsets, dst.offsets)
+			require.Len(t, dst.producers, tt.producers)
+			require.Equal(t, uint64(tt.producers), dst.nextProducerID)
+			if tt.producers > 0 {
+				r, ok, err := dst.producers[1].appended(2)
+				require.NoError(t, err)
+				require.True(t, ok)
+				require.Equal(t, uint64(1), r.Offset)
+			}
+			for off, v := range []string{"first", "second"} {
+				record, err := dst.log.Read(uint64(off))
+				require.NoError(t, err)
+				require.Equal(t, []byte(v), record.Value)
+			}
+
+			topics := dst.topics.List()
+			require.Len(t, topics, tt.topics)
+			if tt.topics > 0 {
+				require.Equal(t, "events", topics[0].Name)
+				require.Equal(t, uint64(24), topics[0].Config.MaxIndexBytes)
+				events, err := dst.topics.Get("events", 0)
+				require.NoError(t, err)
+				for off, v := range []string{"created", "updated", "deleted"} {
+					record, err := events.Read(uint64(off))
+					require.NoError(t, err)
+					require.Equal(t, []byte(v), record.Value)
+				}
+				archived, err := dst.topics.Get("events", 1)
+				require.NoError(t, err)
+				record, err := archived.Read(0)
+				require.NoError(t, err)
+				require.Equal(t, []byte("archived"), record.Value)
+			}
+		})
+	}
+}
+
+func TestFSM_SnapshotRestoreSegments(t *testing.T) {
+	src := newTestFSM(t, "src")
+	require.NoError(t, src.topics.Create("events", &api.TopicConfig{
+		MaxIndexBytes: 2 * entWidth,
+	}))
+	events, err := src.topics.Get("events", 0)
+	require.NoError(t, err)
+	dst := newTestFSM(t, "dst")
+	fetched := serveFrom(t, dst, src)
+
+	restore := func(f *fsm) {
+		snap, err := src.Snapshot()
+		require.NoError(t, err)
+		sink := &testSink{}
+		require.NoError(t, snap.Persist(sink))
+		require.NoError(t, f.Restore(io.NopCloser(sink)))
+	}
+	// Both replicas end their segments at the same offsets.
+	requireLayout := func(log, want *Log) {
+		bounds := func(l *Log) (b [][2]uint64) {
+			for _, s := range l.segments {
+				b = append(b, [2]uint64{s.baseOffset, s.nextOffset})
+			}
+			return b
+		}
+		require.Equal(t, bounds(want), bounds(log))
+	}
+	requireRecords := func(log *Log, want ...string) {
+		for off, v := range want {
+			record, err := log.Read(uint64(off))
+			require.NoError(t, err)
+			require.Equal(t, []byte(v), record.Value)
+		}
+		_, err := log.Read(uint64(len(want)))
+		require.Error(t, err)
+	}
+
+	for _, v := range []string{"first", "second"} {
+		_, err := src.log.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+	for _, v := range []string{"created", "updated", "deleted"} {
+		_, err := events.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+	restore(dst)
+	// One segment of the default log and two of the topic.
+	require.Equal(t, 3, fetched())
+	// Taking a snapshot leaves the active segments as they are.
+	require.Len(t, src.log.segments, 1)
+	require.Len(t, events.segments, 2)
+	dstEvents, err := dst.topics.Get("events", 0)
+	require.NoError(t, err)
+	requireRecords(dst.log, "first", "second")
+	requireRecords(dstEvents, "created", "updated", "deleted")
+	requireLayout(dst.log, src.log)
+	requireLayout(dstEvents, events)
+
+	// Only the segments closed since the last snapshot are fetched.
+	_, err = events.Append(&api.Record{Value: []byte("restored")})
+	require.NoError(t, err)
+	restore(dst)
+	require.Equal(t, 4, fetched())
+	requireRecords(dst.log, "first", "second")
+	requireRecords(dstEvents, "created", "updated", "deleted", "restored")
+	requireLayout(dstEvents, events)
+	off, err := dstEvents.Append(&api.Record{Value: []byte("archived")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	_, err = events.Append(&api.Record{Value: []byte("archived")})
+	require.NoError(t, err)
+	requireLayout(dstEvents, events)
+
+	// Restoring its own snapshot takes a node back to it without fetching,
+	// even once compaction or retention changed the segments.
+	snap, err := src.Snapshot()
+	require.NoError(t, err)
+	sink := &testSink{}
+	require.NoError(t, snap.Persist(sink))
+	_, err = events.Append(&api.Record{Value: []byte("lost")})
+	require.NoError(t, err)
+	require.NoError(t, events.Truncate(1))
+	src.dial = nil
+	require.NoError(t, src.Restore(io.NopCloser(sink)))
+	requireRecords(events, "created", "updated", "deleted", "restored", "archived")
+}
+
+func TestLog_InstallFailed(t *testing.T) {
+	dir, err := os.MkdirTemp("", "install-failed-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth
+	src, err := NewLog(filepath.Join(dir, "src"), c)
+	require.NoError(t, err)
+	defer src.Close()
+	dst, err := NewLog(filepath.Join(dir, "dst"), c)
+	require.NoError(t, err)
+	defer dst.Close()
+
+	for _, v := range []string{"first", "second"} {
+		_, err := src.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+	_, err = dst.Append(&api.Record{Value: []byte("local")})
+	require.NoError(t, err)
+	pinned := filepath.Join(dir, "pinned")
+	m, err := src.pin(pinned)
+	require.NoError(t, err)
+	fetch := func(seg *api.SegmentManifest, dir string) error {
+		r, err := openPinned(pinned, seg)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return writeSegment(r, seg, dir)
+	}
+
+	// A fetched segment can't be moved in, so the segments replaced are
+	// put back.
+	blocked := filepath.Join(dst.Dir, "1.index")
+	require.NoError(t, os.MkdirAll(filepath.Join(blocked, "blocked"), 0755))
+	require.Error(t, dst.install(m, fetch))
+	record, err := dst.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("local"), record.Value)
+
+	require.NoError(t, os.RemoveAll(blocked))
+	require.NoError(t, dst.install(m, fetch))
+	record, err = dst.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), record.Value)
+	_, err = os.Stat(filepath.Join(dst.Dir, replacedDir))
+	require.True(t, os.IsNotExist(err))
+}
@@ -3,23 +3,64 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"os"
 	"sync"
+
+	api "github.com/chmikata/proglog/api/v1"
 )
 
 var (
 	enc = binary.BigEndian
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
 )
 
 const (
 	lenWidth = 8
+
+	// The length prefix of a checksummed record holds the CRC-32C of the
+	// stored payload in its upper 4 bytes and the payload length, tagged
+	// with checksumFlag, in its lower 4 bytes. Records written before
+	// checksums were introduced never have the flag set and are read
+	// unverified.
+	checksumFlag uint64 = 1 << 31
+	maxRecordLen uint64 = checksumFlag - 1
+
+	// A compressed store starts with a header naming its codec: the upper
+	// 4 bytes set and checksumFlag clear, which no length prefix has, and
+	// the codec in the lowest byte.
+	headerMagic uint64 = 0xffffffff << 32
+	headerMask  uint64 = 0xffffffff80000000
 )
 
+func encodeLen(p []byte) uint64 {
+	return uint64(crc32.Checksum(p, crcTable))<<32 | checksumFlag |
+		uint64(len(p))
+}
+
+func decodeLen(v uint64) (size uint64, sum uint32, checked bool) {
+	if v&checksumFlag == 0 {
+		return v, 0, false
+	}
+	return v & maxRecordLen, uint32(v >> 32), true
+}
+
+func validRecord(p []byte, sum uint32, checked bool) bool {
+	return !checked || crc32.Checksum(p, crcTable) == sum
+}
+
 type store struct {
 	file *os.File
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+
+	// codec compresses the blocks of records of a closed segment. The
+	// records of a compressed store start after its header, at start.
+	codec Codec
+	start uint64
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -28,18 +69,47 @@ func newStore(f *os.File) (*store, error) {
 		return nil, err
 	}
 	size := uint64(fi.Size())
-	return &store{
+	s := &store{
 		file: f,
 		size: size,
 		buf:  bufio.NewWriter(f),
-	}, nil
+	}
+	if size < lenWidth {
+		return s, nil
+	}
+	hdr := make([]byte, lenWidth)
+	if _, err := f.ReadAt(hdr, 0); err != nil {
+		return nil, err
+	}
+	if v := enc.Uint64(hdr); v&headerMask == headerMagic {
+		s.codec, s.start = Codec(v), lenWidth
+	}
+	return s, nil
+}
+
+// writeHeader makes the empty store a store of blocks compressed with
+// codec.
+func (s *store) writeHeader(codec Codec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size != 0 {
+		return fmt.Errorf("store %s isn't empty", s.Name())
+	}
+	if err := binary.Write(s.buf, enc, headerMagic|uint64(codec)); err != nil {
+		return err
+	}
+	s.size, s.codec, s.start = lenWidth, codec, lenWidth
+	return nil
 }
 
 func (s *store) Append(p []byte) (uint64, uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if uint64(len(p)) > maxRecordLen {
+		return 0, 0, api.ErrRecordTooLarge{Size: uint64(len(p)), Max: maxRecordLen}
+	}
 	pos := s.size
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	if err := binary.Write(s.buf, enc, encodeLen(p)); err != nil {
 		return 0, 0, err
 	}
 	w, err := s.buf.Write(p)
@@ -61,10 +131,17 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 	if _, err := s.file.ReadAt(size, int64(pos)); err != nil {
 		return nil, err
 	}
-	b := make([]byte, enc.Uint64(size))
+	n, sum, checked := decodeLen(enc.Uint64(size))
+	if n > s.size-pos-lenWidth {
+		return nil, api.ErrCorruptRecord{Path: s.Name(), Pos: pos}
+	}
+	b := make([]byte, n)
 	if _, err := s.file.ReadAt(b, int64(pos+lenWidth)); err != nil {
 		return nil, err
 	}
+	if !validRecord(b, sum, checked) {
+		return nil, api.ErrCorruptRecord{Path: s.Name(), Pos: pos}
+	}
 	return b, nil
 }
 
@@ -77,6 +154,85 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.file.ReadAt(p, off)
 }
 
+// scan walks the records from the end of the header, if any, and returns
+// the position of every complete record and the end of the last one.
+func (s *store) scan() ([]uint64, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return nil, 0, err
+	}
+	var (
+		positions []uint64
+		pos       = s.start
+		seen      bool
+	)
+	for pos+lenWidth <= s.size {
+		n, checked, ok, err := s.header(pos)
+		if err != nil {
+			return nil, 0, err
+		}
+		// A legacy record can't follow a checksummed one, so a zeroed
+		// header after it is filler rather than an empty record.
+		if !ok || seen && !checked {
+			break
+		}
+		seen = seen || checked
+		positions = append(positions, pos)
+		pos += lenWidth + n
+	}
+	return positions, pos, nil
+}
+
+// header reads the length prefix at pos and reports whether the record
+// fits in the file. Only the last record of the file is checksummed here,
+// since that is where a torn write leaves its garbage; corruption further
+// in is reported by Read.
+func (s *store) header(pos uint64) (uint64, bool, bool, error) {
+	hdr := make([]byte, lenWidth)
+	if _, err := s.file.ReadAt(hdr, int64(pos)); err != nil {
+		return 0, false, false, err
+	}
+	n, sum, checked := decodeLen(enc.Uint64(hdr))
+	if n > s.size-pos-lenWidth {
+		return 0, checked, false, nil
+	}
+	if pos+lenWidth+n < s.size || !checked {
+		return n, checked, true, nil
+	}
+	b := make([]byte, n)
+	if _, err := s.file.ReadAt(b, int64(pos+lenWidth)); err != nil {
+		return 0, checked, false, err
+	}
+	return n, checked, validRecord(b, sum, checked), nil
+}
+
+// Sync flushes buffered records and commits the file to disk.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.file.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	if size < s.start {
+		s.codec, s.start = CodecNone, 0
+	}
+	return nil
+}
+
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
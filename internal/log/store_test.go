@@ -2,9 +2,11 @@ package log
 
 import (
 	"bufio"
+	"encoding/binary"
 	"os"
 	"testing"
 
+	api "github.com/chmikata/proglog/api/v1"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -156,6 +158,65 @@ func Test_store_Read(t *testing.T) {
 	}
 }
 
+func Test_store_Read_checksum(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		setup     func(f *os.File)
+		want      []byte
+		assertion assert.ErrorAssertionFunc
+	}{
+		{
+			name: "ok legacy record without checksum",
+			setup: func(f *os.File) {
+				binary.Write(f, enc, uint64(4))
+				f.Write([]byte("test"))
+			},
+			want: []byte("test"),
+			assertion: func(tt assert.TestingT, err error, i ...interface{}) bool {
+				return assert.NoError(tt, err)
+			},
+		},
+		{
+			name: "error checksum mismatch",
+			setup: func(f *os.File) {
+				binary.Write(f, enc, encodeLen([]byte("test")))
+				f.Write([]byte("tost"))
+			},
+			want: nil,
+			assertion: func(tt assert.TestingT, err error, i ...interface{}) bool {
+				return assert.Equal(tt, api.ErrCorruptRecord{Path: i[0].(string), Pos: 0}, err)
+			},
+		},
+		{
+			name: "error torn record",
+			setup: func(f *os.File) {
+				binary.Write(f, enc, encodeLen([]byte("test")))
+				f.Write([]byte("te"))
+			},
+			want: nil,
+			assertion: func(tt assert.TestingT, err error, i ...interface{}) bool {
+				return assert.Equal(tt, api.ErrCorruptRecord{Path: i[0].(string), Pos: 0}, err)
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, _ := os.CreateTemp("", "Test_store_Read_checksum")
+			t.Cleanup(func() { os.Remove(f.Name()) })
+			tt.setup(f)
+			st, _ := newStore(f)
+			got, err := st.Read(0)
+			tt.assertion(t, err, f.Name())
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
 func Test_store_ReadAt(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,113 @@
+package log
+
+import (
+	"sort"
+)
+
+// timeIndexInterval is the number of store bytes written between two
+// entries of the sparse time index.
+const timeIndexInterval = 4096
+
+// The time index reuses the index file layout: each entry holds the
+// relative offset of a record and, in place of a store position, the
+// highest timestamp of any record up to and including it. Entries are
+// therefore ordered by both offset and timestamp.
+
+// loadTimeIndex drops time index entries left behind by an unclean
+// shutdown and indexes the records written after the last good entry.
+func (s *segment) loadTimeIndex() error {
+	entries := s.timeIndex.size / entWidth
+	if limit := uint64(len(s.timeIndex.mmap)) / entWidth; entries > limit {
+		entries = limit
+	}
+	var (
+		kept    uint64
+		lastOff int64 = -1
+		lastTs  int64
+		next    int64
+	)
+	for ; kept < entries; kept++ {
+		off, ts, err := s.timeIndex.Read(int64(kept))
+		if err != nil ||
+			int64(off) <= lastOff ||
+			s.baseOffset+uint64(off) >= s.nextOffset ||
+			int64(ts) < lastTs {
+			break
+		}
+		i, err := s.entry(s.baseOffset + uint64(off))
+		if err != nil {
+			break
+		}
+		lastOff, lastTs, next = int64(off), int64(ts), i+1
+	}
+	s.timeIndex.size = kept * entWidth
+
+	s.maxTimestamp, s.timeIndexedAt = 0, 0
+	if kept > 0 {
+		_, pos, err := s.index.Read(next - 1)
+		if err != nil {
+			return err
+		}
+		s.maxTimestamp, s.timeIndexedAt = lastTs, pos
+	}
+	for i := next; i < int64(s.index.size/entWidth); i++ {
+		record, err := s.readEntry(i)
+		if err != nil {
+			return err
+		}
+		_, pos, err := s.index.Read(i)
+		if err != nil {
+			return err
+		}
+		s.indexTime(record.Timestamp, record.Offset, pos)
+	}
+	return nil
+}
+
+// indexTime records the timestamp of the record at off, adding a time index
+// entry once timeIndexInterval bytes have been written since the last one.
+// A full time index just stops growing; lookups then scan further.
+func (s *segment) indexTime(ts int64, off, pos uint64) {
+	if ts > s.maxTimestamp {
+		s.maxTimestamp = ts
+	}
+	if s.timeIndex.size != 0 && pos-s.timeIndexedAt < timeIndexInterval {
+		return
+	}
+	if s.timeIndex.isMaxed() {
+		return
+	}
+	_ = s.timeIndex.Write(uint32(off-s.baseOffset), uint64(s.maxTimestamp))
+	s.timeIndexedAt = pos
+}
+
+// offsetForTime returns the first offset in the segment whose record has a
+// timestamp at or after ts.
+func (s *segment) offsetForTime(ts int64) (uint64, bool, error) {
+	entries := int(s.timeIndex.size / entWidth)
+	i := sort.Search(entries, func(i int) bool {
+		_, highest, _ := s.timeIndex.Read(int64(i))
+		return int64(highest) >= ts
+	})
+	var next int64
+	if i > 0 {
+		off, _, err := s.timeIndex.Read(int64(i - 1))
+		if err != nil {
+			return 0, false, err
+		}
+		if next, err = s.entry(s.baseOffset + uint64(off)); err != nil {
+			return 0, false, err
+		}
+		next++
+	}
+	for ; next < int64(s.index.size/entWidth); next++ {
+		record, err := s.readEntry(next)
+		if err != nil {
+			return 0, false, err
+		}
+		if record.Timestamp >= ts {
+			return record.Offset, true, nil
+		}
+	}
+	return 0, false, nil
+}
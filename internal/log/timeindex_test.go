@@ -0,0 +1,77 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/chmikata/proglog/api/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_segment_loadTimeIndex(t *testing.T) {
+	t.Parallel()
+
+	c := Config{
+		Segment: struct {
+			MaxStoreBytes uint64
+			MaxIndexBytes uint64
+			InitialOffset uint64
+			Sync          SyncPolicy
+			SyncInterval  time.Duration
+		}{
+			MaxStoreBytes: 1024,
+			MaxIndexBytes: 120,
+			InitialOffset: 0,
+		},
+	}
+	type test struct {
+		name  string
+		crash func(timeIndex string)
+	}
+	tests := []test{
+		{
+			name:  "ok clean case",
+			crash: func(_ string) {},
+		},
+		{
+			name: "ok time index missing case",
+			crash: func(timeIndex string) {
+				os.Remove(timeIndex)
+			},
+		},
+		{
+			name: "ok time index left unsynced case",
+			crash: func(timeIndex string) {
+				os.Truncate(timeIndex, int64(c.Segment.MaxIndexBytes))
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir, _ := os.MkdirTemp("", "Test_segment_loadTimeIndex")
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			seg, _ := newSegment(dir, 0, c)
+			for i := int64(1); i <= 4; i++ {
+				seg.Append(&api.Record{Value: []byte("hello world"), Timestamp: i * 10})
+			}
+			seg.Close()
+			tt.crash(seg.timeIndex.Name())
+
+			got, err := newSegment(dir, 0, c)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(40), got.maxTimestamp)
+			assert.Equal(t, entWidth, got.timeIndex.size)
+			off, ok, err := got.offsetForTime(25)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, uint64(2), off)
+			_, ok, err = got.offsetForTime(41)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+		})
+	}
+}
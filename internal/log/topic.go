@@ -0,0 +1,283 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	api "github.com/chmikata/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const topicConfigFile = "config"
+
+var topicName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// Topics manages named logs. Each topic lives in a subdirectory of Dir,
+// holding its config and a log directory per partition, and runs with
+// Config overridden by its own TopicConfig.
+type Topics struct {
+	Dir    string
+	Config Config
+
+	// replicated topics leave retention and compaction to Raft.
+	replicated bool
+
+	mu     sync.RWMutex
+	topics map[string]*topic
+}
+
+type topic struct {
+	config     *api.TopicConfig
+	partitions []*Log
+}
+
+// NewTopics opens the topics already in dir.
+func NewTopics(dir string, c Config) (*Topics, error) {
+	return newTopics(dir, c, false)
+}
+
+func newTopics(dir string, c Config, replicated bool) (*Topics, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	t := &Topics{
+		Dir:        dir,
+		Config:     c,
+		replicated: replicated,
+		topics:     make(map[string]*topic),
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !topicName.MatchString(entry.Name()) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, entry.Name(), topicConfigFile))
+		if os.IsNotExist(err) {
+			// creation didn't finish
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		config := &api.TopicConfig{}
+		if err := proto.Unmarshal(b, config); err != nil {
+			return nil, err
+		}
+		if err := t.open(entry.Name(), config); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *Topics) open(name string, config *api.TopicConfig) error {
+	tp := &topic{config: config}
+	for i := uint32(0); i < partitionCount(config); i++ {
+		log, err := NewLog(
+			filepath.Join(t.Dir, name, strconv.FormatUint(uint64(i), 10)),
+			t.logConfig(config),
+		)
+		if err != nil {
+			tp.close()
+			return err
+		}
+		tp.partitions = append(tp.partitions, log)
+	}
+	t.topics[name] = tp
+	return nil
+}
+
+// partitionCount returns the number of partitions of a topic.
+func partitionCount(config *api.TopicConfig) uint32 {
+	if config.Partitions == 0 {
+		return 1
+	}
+	return config.Partitions
+}
+
+// logConfig returns the config the log of a topic runs with.
+func (t *Topics) logConfig(config *api.TopicConfig) Config {
+	c := t.Config
+	if config.MaxStoreBytes != 0 {
+		c.Segment.MaxStoreBytes = config.MaxStoreBytes
+	}
+	if config.MaxIndexBytes != 0 {
+		c.Segment.MaxIndexBytes = config.MaxIndexBytes
+	}
+	if !t.replicated {
+		c.Retention = retentionConfig(c, config).Retention
+	}
+	if config.Compaction && !t.replicated {
+		c.Compaction.Enabled = true
+	}
+	c.Segment.InitialOffset = 0
+	return c
+}
+
+// retentionConfig returns c with the retention of a topic applied.
+func retentionConfig(c Config, config *api.TopicConfig) Config {
+	if config.RetentionMaxBytes != 0 {
+		c.Retention.MaxBytes = config.RetentionMaxBytes
+	}
+	if config.RetentionMaxAge != 0 {
+		c.Retention.MaxAge = time.Duration(config.RetentionMaxAge)
+	}
+	return c
+}
+
+// Create creates a topic.
+func (t *Topics) Create(name string, config *api.TopicConfig) error {
+	if !topicName.MatchString(name) || name == "." || name == ".." {
+		return api.ErrInvalidTopicName{Topic: name}
+	}
+	if config == nil {
+		config = &api.TopicConfig{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.topics[name]; ok {
+		return api.ErrTopicExists{Topic: name}
+	}
+	dir := filepath.Join(t.Dir, name)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	b, err := proto.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, topicConfigFile), b, 0644); err != nil {
+		return err
+	}
+	return t.open(name, config)
+}
+
+// Delete removes a topic and its records.
+func (t *Topics) Delete(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tp, ok := t.topics[name]
+	if !ok {
+		return api.ErrTopicNotFound{Topic: name}
+	}
+	delete(t.topics, name)
+	if err := tp.close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(t.Dir, name))
+}
+
+// Get returns the log of a partition of a topic.
+func (t *Topics) Get(name string, partition uint32) (*Log, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tp, ok := t.topics[name]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	if partition >= uint32(len(tp.partitions)) {
+		return nil, api.ErrPartitionNotFound{Topic: name, Partition: partition}
+	}
+	return tp.partitions[partition], nil
+}
+
+// config returns the config of a topic.
+func (t *Topics) config(name string) (*api.TopicConfig, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tp, ok := t.topics[name]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	return tp.config, nil
+}
+
+// List returns the topics sorted by name.
+func (t *Topics) List() []*api.Topic {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	topics := make([]*api.Topic, 0, len(t.topics))
+	for name, tp := range t.topics {
+		topics = append(topics, &api.Topic{Name: name, Config: tp.config})
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+	return topics
+}
+
+// Reset replaces every topic with an empty one of the given topics.
+func (t *Topics) Reset(topics []*api.Topic) error {
+	for _, tp := range t.List() {
+		if err := t.Delete(tp.Name); err != nil {
+			return err
+		}
+	}
+	for _, tp := range topics {
+		if err := t.Create(tp.Name, tp.Config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace makes the topics those given. Topics that already exist with
+// the same config are kept along with their records; the others are
+// replaced with empty ones.
+func (t *Topics) replace(topics []*api.Topic) error {
+	want := make(map[string]*api.TopicConfig, len(topics))
+	for _, tp := range topics {
+		want[tp.Name] = tp.Config
+	}
+	kept := make(map[string]bool)
+	for _, tp := range t.List() {
+		config, ok := want[tp.Name]
+		if ok && proto.Equal(config, tp.Config) {
+			kept[tp.Name] = true
+			continue
+		}
+		if err := t.Delete(tp.Name); err != nil {
+			return err
+		}
+	}
+	for _, tp := range topics {
+		if kept[tp.Name] {
+			continue
+		}
+		if err := t.Create(tp.Name, tp.Config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Topics) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tp := range t.topics {
+		if err := tp.close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tp *topic) close() error {
+	for _, log := range tp.partitions {
+		if err := log.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	api "github.com/chmikata/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopics(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestTopics")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topics, err := NewTopics(dir, Config{})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		topic string
+		err   error
+	}{
+		{
+			name:  "ok case",
+			topic: "orders",
+		},
+		{
+			name:  "ok case other topic",
+			topic: "billing.v1",
+		},
+		{
+			name:  "ng case exists",
+			topic: "orders",
+			err:   api.ErrTopicExists{Topic: "orders"},
+		},
+		{
+			name:  "ng case path",
+			topic: "../orders",
+			err:   api.ErrInvalidTopicName{Topic: "../orders"},
+		},
+		{
+			name:  "ng case parent",
+			topic: "..",
+			err:   api.ErrInvalidTopicName{Topic: ".."},
+		},
+	}
+	for _, tt := range tests {
+		err := topics.Create(tt.topic, &api.TopicConfig{MaxIndexBytes: 24})
+		require.Equal(t, tt.err, err, tt.name)
+	}
+
+	orders, err := topics.Get("orders", 0)
+	require.NoError(t, err)
+	off, err := orders.Append(&api.Record{Value: []byte("ordered")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.Equal(t, uint64(24), orders.Config.Segment.MaxIndexBytes)
+
+	require.NoError(t, topics.Delete("billing.v1"))
+	require.Equal(t, api.ErrTopicNotFound{Topic: "billing.v1"}, topics.Delete("billing.v1"))
+	_, err = topics.Get("billing.v1", 0)
+	require.Equal(t, api.ErrTopicNotFound{Topic: "billing.v1"}, err)
+	require.NoError(t, topics.Close())
+
+	topics, err = NewTopics(dir, Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	list := topics.List()
+	require.Len(t, list, 1)
+	require.Equal(t, "orders", list[0].Name)
+	require.Equal(t, uint64(24), list[0].Config.MaxIndexBytes)
+	orders, err = topics.Get("orders", 0)
+	require.NoError(t, err)
+	record, err := orders.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ordered"), record.Value)
+}
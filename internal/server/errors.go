@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	api "github.com/chmikata/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *grpcServer) unaryErrorInterceptor(
+	ctx context.Context,
+	req any,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (any, error) {
+	res, err := handler(ctx, req)
+	if err != nil {
+		return nil, s.grpcError(err)
+	}
+	return res, nil
+}
+
+func (s *grpcServer) streamErrorInterceptor(
+	srv any,
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if err := handler(srv, stream); err != nil {
+		return s.grpcError(err)
+	}
+	return nil
+}
+
+// grpcError maps an error returned by a handler to the status clients see.
+// Errors from api/v1 and errors that already carry a status are passed
+// through; anything else unknown is an internal failure of the server.
+func (s *grpcServer) grpcError(err error) error {
+	if _, ok := err.(interface{ GRPCStatus() *status.Status }); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	case errors.Is(err, raft.ErrNotLeader):
+		var hint api.ErrNotLeader
+		if s.Leader != nil {
+			hint.LeaderID, hint.LeaderAddr, _ = s.Leader.Leader()
+		}
+		return hint
+	case errors.Is(err, raft.ErrLeadershipLost),
+		errors.Is(err, raft.ErrLeadershipTransferInProgress),
+		errors.Is(err, raft.ErrAbortedByRestore):
+		return api.ErrLeadershipChanged{Cause: err.Error()}
+	case errors.Is(err, raft.ErrEnqueueTimeout):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, raft.ErrRaftShutdown):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(codes.Internal, err.Error())
+}
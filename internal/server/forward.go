@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	api "github.com/chmikata/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// forwardedSubjectKey carries the subject of the original caller on a
+// request a follower forwards to the leader. The leader only trusts it from
+// peers allowed to forward.
+const forwardedSubjectKey = "proglog-forwarded-subject"
+
+// LeaderLocator tells where the leader of the cluster is.
+type LeaderLocator interface {
+	Leader() (id, addr string, isLeader bool)
+}
+
+// Forwarder keeps a connection to every leader requests were forwarded to.
+// Its owner closes it once the server has stopped.
+type Forwarder struct {
+	opts []grpc.DialOption
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func NewForwarder(opts ...grpc.DialOption) *Forwarder {
+	return &Forwarder{
+		opts:  opts,
+		conns: make(map[string]*grpc.ClientConn),
+	}
+}
+
+func (f *Forwarder) client(addr string) (api.LogClient, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.conns == nil {
+		return nil, nil
+	}
+	conn, ok := f.conns[addr]
+	if !ok {
+		var err error
+		conn, err = grpc.Dial(addr, f.opts...)
+		if err != nil {
+			return nil, err
+		}
+		f.conns[addr] = conn
+	}
+	return api.NewLogClient(conn), nil
+}
+
+// Close closes the connections to the leaders. Writes aren't forwarded
+// anymore afterwards.
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var err error
+	for _, conn := range f.conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	f.conns = nil
+	return err
+}
+
+// leaderClient returns a client of the leader if a request that failed
+// with err should be forwarded to it, or nil otherwise. Only requests this
+// node refused as a follower are forwarded: any other error may come from
+// a write that was committed anyway, or from a request the leader would
+// refuse too.
+func (s *grpcServer) leaderClient(ctx context.Context, err error) (api.LogClient, error) {
+	if !errors.Is(err, raft.ErrNotLeader) {
+		return nil, nil
+	}
+	if s.Leader == nil || s.Forwarder == nil || s.DisableForwarding || forwarded(ctx) {
+		return nil, nil
+	}
+	_, addr, isLeader := s.Leader.Leader()
+	if isLeader || addr == "" {
+		return nil, nil
+	}
+	return s.Forwarder.client(addr)
+}
+
+// forwardContext passes the caller's subject on to the leader.
+func forwardContext(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(
+		ctx,
+		forwardedSubjectKey,
+		subject(ctx),
+	)
+}
+
+func forwarded(ctx context.Context) bool {
+	v, _ := ctx.Value(forwardedContextKey{}).(bool)
+	return v
+}
+
+type forwardedContextKey struct{}
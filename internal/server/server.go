@@ -15,6 +15,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 
@@ -26,12 +27,38 @@ type Config struct {
 	CommitLog   CommitLog
 	Authorizer  Authorizer
 	GetServerer GetServerer
+	// OffsetCommitter keeps the offsets of consumer groups. The group RPCs
+	// are unimplemented if it is nil.
+	OffsetCommitter OffsetCommitter
+	// Appender applies the options of a ProduceRequest, deduplicating the
+	// records of idempotent producers and checking conditional appends.
+	// Requests using them are rejected if it is nil.
+	Appender Appender
+	// Topics manages the named topics. Requests naming a topic are
+	// unimplemented if it is nil.
+	Topics TopicManager
+	// Snapshotter takes snapshots of this node on demand. The Snapshot RPC
+	// is unimplemented if it is nil.
+	Snapshotter Snapshotter
+	// Leader and Forwarder let a follower forward writes and linearizable
+	// reads to the leader. They aren't forwarded if either is nil or
+	// DisableForwarding is set; the follower then replies with ErrNotLeader
+	// instead.
+	Leader            LeaderLocator
+	Forwarder         *Forwarder
+	DisableForwarding bool
 }
 
 const (
 	objectWildcard = "*"
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	forwardAction  = "forward"
+	adminAction    = "admin"
+
+	// groupObjectPrefix scopes the consume action to a consumer group, so a
+	// policy can allow a caller only some groups.
+	groupObjectPrefix = "groups/"
 )
 
 var _ api.LogServer = (*grpcServer)(nil)
@@ -43,7 +70,43 @@ type grpcServer struct {
 
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) (uint64, error)
 	Read(uint64) (*api.Record, error)
+	OffsetForTime(time.Time) (uint64, error)
+	ReadBatch(off uint64, maxRecords int, maxBytes uint64) ([]*api.Record, error)
+	WaitForOffset(context.Context, uint64) error
+	Info() (*api.LogInfo, error)
+	ReadBarrier(context.Context, api.ReadConsistency, uint64) error
+}
+
+// defaultBatchBytes bounds a ConsumeBatch response that sets no limits,
+// keeping it well under the gRPC message size limit.
+const defaultBatchBytes = 1 << 20
+
+type OffsetCommitter interface {
+	CommitOffset(group string, off uint64) error
+	FetchOffset(group string) (uint64, error)
+}
+
+type Appender interface {
+	RegisterProducer() (uint64, error)
+	AppendRequest(*api.ProduceRequest) (*api.ProduceResponse, error)
+	AppendBatchRequest(*api.ProduceBatchRequest) (*api.ProduceBatchResponse, error)
+}
+
+type TopicManager interface {
+	CreateTopic(name string, config *api.TopicConfig) error
+	DeleteTopic(name string) error
+	ListTopics() ([]*api.Topic, error)
+	ReadTopic(topic string, partition uint32, off uint64) (*api.Record, error)
+	ReadTopicBatch(topic string, partition uint32, off uint64, maxRecords int, maxBytes uint64) ([]*api.Record, error)
+	WaitForTopicOffset(ctx context.Context, topic string, partition uint32, off uint64) error
+	TopicOffsetForTime(topic string, partition uint32, t time.Time) (uint64, error)
+	TopicInfo(topic string, partition uint32) (*api.LogInfo, error)
+}
+
+type Snapshotter interface {
+	Snapshot() (*api.SnapshotInfo, error)
 }
 
 type Authorizer interface {
@@ -54,18 +117,25 @@ func NewGRPCServer(config *Config,
 	tp *trace.TracerProvider,
 	grpcOpts ...grpc.ServerOption) (*grpc.Server, error) {
 
+	srv, err := newgrpcServer(config)
+	if err != nil {
+		return nil, err
+	}
+
 	interceptorOpt := otelgrpc.WithTracerProvider(tp)
 	grpcOpts = append(grpcOpts,
 		grpc.StreamInterceptor(
 			grpc_middleware.ChainStreamServer(
 				otelgrpc.StreamServerInterceptor(interceptorOpt),
-				grpc_auth.StreamServerInterceptor(authenticate),
+				srv.streamErrorInterceptor,
+				grpc_auth.StreamServerInterceptor(srv.authenticate),
 			),
 		),
 		grpc.UnaryInterceptor(
 			grpc_middleware.ChainUnaryServer(
 				otelgrpc.UnaryServerInterceptor(interceptorOpt),
-				grpc_auth.UnaryServerInterceptor(authenticate),
+				srv.unaryErrorInterceptor,
+				grpc_auth.UnaryServerInterceptor(srv.authenticate),
 			),
 		),
 	)
@@ -75,10 +145,6 @@ func NewGRPCServer(config *Config,
 	hsrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
 	healthpb.RegisterHealthServer(gsrv, hsrv)
 
-	srv, err := newgrpcServer(config)
-	if err != nil {
-		return nil, err
-	}
 	api.RegisterLogServer(gsrv, srv)
 	return gsrv, nil
 }
@@ -91,6 +157,52 @@ func newgrpcServer(config *Config) (*grpcServer, error) {
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		topicObject(req.Topic),
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+	res, err := s.append(req)
+	if err != nil {
+		client, ferr := s.leaderClient(ctx, err)
+		if ferr != nil || client == nil {
+			return nil, err
+		}
+		return client.Produce(forwardContext(ctx), req)
+	}
+	return res, nil
+}
+
+func (s *grpcServer) append(req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	if req.Topic == "" &&
+		req.Partition == nil &&
+		req.ProducerId == 0 &&
+		req.ExpectedLastOffset == nil &&
+		req.ExpectedKeyOffset == nil {
+		offset, err := s.CommitLog.Append(req.Record)
+		if err != nil {
+			return nil, err
+		}
+		return &api.ProduceResponse{Offset: offset}, nil
+	}
+	if req.Topic != "" && s.Topics == nil {
+		return nil, errTopicsUnimplemented
+	}
+	if s.Appender == nil {
+		return nil, status.Error(codes.Unimplemented, "produce options aren't supported")
+	}
+	if req.ProducerId != 0 && req.Sequence == 0 {
+		return nil, status.Error(codes.InvalidArgument, "sequence numbers start at 1")
+	}
+	if req.ExpectedKeyOffset != nil && len(req.Record.Key) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "expected key offset without a key")
+	}
+	return s.Appender.AppendRequest(req)
+}
+
+func (s *grpcServer) RegisterProducer(ctx context.Context, req *api.RegisterProducerRequest) (*api.RegisterProducerResponse, error) {
 	if err := s.Authorizer.Authorize(
 		subject(ctx),
 		objectWildcard,
@@ -98,28 +210,171 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api
 	); err != nil {
 		return nil, err
 	}
-	offset, err := s.CommitLog.Append(req.Record)
+	if s.Appender == nil {
+		return nil, status.Error(codes.Unimplemented, "produce options aren't supported")
+	}
+	id, err := s.Appender.RegisterProducer()
 	if err != nil {
+		client, ferr := s.leaderClient(ctx, err)
+		if ferr != nil || client == nil {
+			return nil, err
+		}
+		return client.RegisterProducer(forwardContext(ctx), req)
+	}
+	return &api.RegisterProducerResponse{ProducerId: id}, nil
+}
+
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		topicObject(req.Topic),
+		produceAction,
+	); err != nil {
 		return nil, err
 	}
-	return &api.ProduceResponse{Offset: offset}, nil
+	if len(req.Records) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "empty batch")
+	}
+	res, err := s.appendBatch(req)
+	if err != nil {
+		client, ferr := s.leaderClient(ctx, err)
+		if ferr != nil || client == nil {
+			return nil, err
+		}
+		return client.ProduceBatch(forwardContext(ctx), req)
+	}
+	return res, nil
+}
+
+func (s *grpcServer) appendBatch(req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	if req.Topic == "" && req.Partition == nil {
+		first, err := s.CommitLog.AppendBatch(req.Records)
+		if err != nil {
+			return nil, err
+		}
+		return &api.ProduceBatchResponse{
+			FirstOffset: first,
+			LastOffset:  first + uint64(len(req.Records)) - 1,
+		}, nil
+	}
+	if req.Topic != "" && s.Topics == nil {
+		return nil, errTopicsUnimplemented
+	}
+	if s.Appender == nil {
+		return nil, status.Error(codes.Unimplemented, "produce options aren't supported")
+	}
+	return s.Appender.AppendBatchRequest(req)
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
 	if err := s.Authorizer.Authorize(
 		subject(ctx),
-		objectWildcard,
-		produceAction,
+		topicObject(req.Topic),
+		consumeAction,
 	); err != nil {
 		return nil, err
 	}
-	record, err := s.CommitLog.Read(req.Offset)
+	if err := s.readBarrier(
+		ctx,
+		req.Topic,
+		req.Partition,
+		req.Consistency,
+		req.MinOffset,
+	); err != nil {
+		client, ferr := s.leaderClient(ctx, err)
+		if ferr != nil || client == nil {
+			return nil, err
+		}
+		return client.Consume(forwardContext(ctx), req)
+	}
+	var (
+		record *api.Record
+		err    error
+	)
+	if req.Topic == "" {
+		record, err = s.CommitLog.Read(req.Offset)
+	} else {
+		record, err = s.Topics.ReadTopic(req.Topic, req.Partition, req.Offset)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+// readBarrier returns once a read of a partition at the given consistency
+// may proceed. It also rejects partitions of the default log and topics on
+// a server without them.
+func (s *grpcServer) readBarrier(
+	ctx context.Context,
+	topic string,
+	partition uint32,
+	consistency api.ReadConsistency,
+	minOffset uint64,
+) error {
+	if topic == "" && partition != 0 {
+		return api.ErrPartitionNotFound{Partition: partition}
+	}
+	if topic == "" {
+		return s.CommitLog.ReadBarrier(ctx, consistency, minOffset)
+	}
+	if s.Topics == nil {
+		return errTopicsUnimplemented
+	}
+	// Only the default log's offsets are known to ReadBarrier, so waiting
+	// for an offset of a topic is done here.
+	if consistency == api.ReadConsistency_READ_AT_LEAST_OFFSET {
+		return s.Topics.WaitForTopicOffset(ctx, topic, partition, minOffset)
+	}
+	return s.CommitLog.ReadBarrier(ctx, consistency, 0)
+}
+
+func (s *grpcServer) ConsumeBatch(ctx context.Context, req *api.ConsumeBatchRequest) (*api.ConsumeBatchResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		topicObject(req.Topic),
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if err := s.readBarrier(
+		ctx,
+		req.Topic,
+		req.Partition,
+		req.Consistency,
+		req.MinOffset,
+	); err != nil {
+		client, ferr := s.leaderClient(ctx, err)
+		if ferr != nil || client == nil {
+			return nil, err
+		}
+		return client.ConsumeBatch(forwardContext(ctx), req)
+	}
+	maxBytes := req.MaxBytes
+	if req.MaxRecords == 0 && maxBytes == 0 {
+		maxBytes = defaultBatchBytes
+	}
+	var (
+		records []*api.Record
+		err     error
+	)
+	if req.Topic == "" {
+		records, err = s.CommitLog.ReadBatch(req.Offset, int(req.MaxRecords), maxBytes)
+	} else {
+		records, err = s.Topics.ReadTopicBatch(
+			req.Topic,
+			req.Partition,
+			req.Offset,
+			int(req.MaxRecords),
+			maxBytes,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &api.ConsumeBatchResponse{Records: records}, nil
+}
+
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	for {
 		req, err := stream.Recv()
@@ -137,16 +392,37 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 }
 
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	if req.Group != "" {
+		res, err := s.FetchOffset(stream.Context(), &api.FetchOffsetRequest{
+			Group: req.Group,
+		})
+		switch err.(type) {
+		case nil:
+			req.Offset = res.Offset
+		case api.ErrNoCommittedOffset:
+		default:
+			return err
+		}
+	}
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
 		default:
-			res, err := s.Consume(stream.Context(), req)
+			res, next, err := s.consumeNext(stream.Context(), req)
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
-				time.Sleep(time.Second)
+				err := s.waitForOffset(stream.Context(), req)
+				if stream.Context().Err() != nil {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			case api.ErrOffsetCompacted:
+				req.Offset++
 				continue
 			default:
 				return err
@@ -154,11 +430,232 @@ func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Consu
 			if err = stream.Send(res); err != nil {
 				return err
 			}
-			req.Offset++
+			req.Offset = next
+			// The consistency applies to where the stream starts; later
+			// records are only sent once they have been applied anyway.
+			req.Consistency = api.ReadConsistency_READ_ANY
 		}
 	}
 }
 
+// waitForOffset blocks until the record at req.Offset of the partition req
+// reads from has been applied.
+func (s *grpcServer) waitForOffset(ctx context.Context, req *api.ConsumeRequest) error {
+	if req.Topic == "" {
+		return s.CommitLog.WaitForOffset(ctx, req.Offset)
+	}
+	return s.Topics.WaitForTopicOffset(ctx, req.Topic, req.Partition, req.Offset)
+}
+
+// consumeNext reads the next response of a ConsumeStream and returns the
+// offset to continue from. Batched responses skip compacted offsets.
+func (s *grpcServer) consumeNext(ctx context.Context, req *api.ConsumeRequest) (
+	*api.ConsumeResponse, uint64, error,
+) {
+	if req.MaxRecords == 0 && req.MaxBytes == 0 {
+		res, err := s.Consume(ctx, req)
+		return res, req.Offset + 1, err
+	}
+	res, err := s.ConsumeBatch(ctx, &api.ConsumeBatchRequest{
+		Offset:      req.Offset,
+		MaxRecords:  req.MaxRecords,
+		MaxBytes:    req.MaxBytes,
+		Consistency: req.Consistency,
+		MinOffset:   req.MinOffset,
+		Topic:       req.Topic,
+		Partition:   req.Partition,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	last := res.Records[len(res.Records)-1]
+	return &api.ConsumeResponse{Records: res.Records}, last.Offset + 1, nil
+}
+
+func (s *grpcServer) GetOffsetForTime(ctx context.Context, req *api.GetOffsetForTimeRequest) (*api.GetOffsetForTimeResponse, error) {
+	if err := s.authorizePartition(ctx, req.Topic, req.Partition); err != nil {
+		return nil, err
+	}
+	var (
+		offset uint64
+		err    error
+	)
+	t := time.Unix(0, req.Timestamp)
+	if req.Topic == "" {
+		offset, err = s.CommitLog.OffsetForTime(t)
+	} else {
+		offset, err = s.Topics.TopicOffsetForTime(req.Topic, req.Partition, t)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetOffsetForTimeResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) GetLogInfo(ctx context.Context, req *api.GetLogInfoRequest) (*api.GetLogInfoResponse, error) {
+	if err := s.authorizePartition(ctx, req.Topic, req.Partition); err != nil {
+		return nil, err
+	}
+	var (
+		info *api.LogInfo
+		err  error
+	)
+	if req.Topic == "" {
+		info, err = s.CommitLog.Info()
+	} else {
+		info, err = s.Topics.TopicInfo(req.Topic, req.Partition)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetLogInfoResponse{Info: info}, nil
+}
+
+// authorizePartition authorizes consuming a partition and rejects the
+// partitions of the default log and topics on a server without them.
+func (s *grpcServer) authorizePartition(ctx context.Context, topic string, partition uint32) error {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		topicObject(topic),
+		consumeAction,
+	); err != nil {
+		return err
+	}
+	if topic == "" && partition != 0 {
+		return api.ErrPartitionNotFound{Partition: partition}
+	}
+	if topic != "" && s.Topics == nil {
+		return errTopicsUnimplemented
+	}
+	return nil
+}
+
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group); err != nil {
+		return nil, err
+	}
+	if err := s.OffsetCommitter.CommitOffset(req.Group, req.Offset); err != nil {
+		client, ferr := s.leaderClient(ctx, err)
+		if ferr != nil || client == nil {
+			return nil, err
+		}
+		return client.CommitOffset(forwardContext(ctx), req)
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+func (s *grpcServer) FetchOffset(ctx context.Context, req *api.FetchOffsetRequest) (*api.FetchOffsetResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group); err != nil {
+		return nil, err
+	}
+	offset, err := s.OffsetCommitter.FetchOffset(req.Group)
+	if err != nil {
+		return nil, err
+	}
+	return &api.FetchOffsetResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) authorizeGroup(ctx context.Context, group string) error {
+	if s.OffsetCommitter == nil {
+		return status.Error(codes.Unimplemented, "consumer groups aren't supported")
+	}
+	if group == "" {
+		return status.Error(codes.InvalidArgument, "empty consumer group")
+	}
+	return s.Authorizer.Authorize(
+		subject(ctx),
+		groupObjectPrefix+group,
+		consumeAction,
+	)
+}
+
+func (s *grpcServer) CreateTopic(ctx context.Context, req *api.CreateTopicRequest) (*api.CreateTopicResponse, error) {
+	if err := s.authorizeTopic(ctx, req.Topic.GetName(), adminAction); err != nil {
+		return nil, err
+	}
+	if err := s.Topics.CreateTopic(req.Topic.Name, req.Topic.Config); err != nil {
+		client, ferr := s.leaderClient(ctx, err)
+		if ferr != nil || client == nil {
+			return nil, err
+		}
+		return client.CreateTopic(forwardContext(ctx), req)
+	}
+	return &api.CreateTopicResponse{}, nil
+}
+
+func (s *grpcServer) DeleteTopic(ctx context.Context, req *api.DeleteTopicRequest) (*api.DeleteTopicResponse, error) {
+	if err := s.authorizeTopic(ctx, req.Name, adminAction); err != nil {
+		return nil, err
+	}
+	if err := s.Topics.DeleteTopic(req.Name); err != nil {
+		client, ferr := s.leaderClient(ctx, err)
+		if ferr != nil || client == nil {
+			return nil, err
+		}
+		return client.DeleteTopic(forwardContext(ctx), req)
+	}
+	return &api.DeleteTopicResponse{}, nil
+}
+
+func (s *grpcServer) ListTopics(ctx context.Context, req *api.ListTopicsRequest) (*api.ListTopicsResponse, error) {
+	if s.Topics == nil {
+		return nil, errTopicsUnimplemented
+	}
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	topics, err := s.Topics.ListTopics()
+	if err != nil {
+		return nil, err
+	}
+	return &api.ListTopicsResponse{Topics: topics}, nil
+}
+
+// Snapshot takes a snapshot of the node serving the request, which lets it
+// drop the Raft log entries the snapshot covers.
+func (s *grpcServer) Snapshot(ctx context.Context, req *api.SnapshotRequest) (*api.SnapshotResponse, error) {
+	if s.Snapshotter == nil {
+		return nil, status.Error(codes.Unimplemented, "snapshots aren't supported")
+	}
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		adminAction,
+	); err != nil {
+		return nil, err
+	}
+	info, err := s.Snapshotter.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &api.SnapshotResponse{Snapshot: info}, nil
+}
+
+func (s *grpcServer) authorizeTopic(ctx context.Context, topic, action string) error {
+	if s.Topics == nil {
+		return errTopicsUnimplemented
+	}
+	if topic == "" {
+		return status.Error(codes.InvalidArgument, "empty topic")
+	}
+	return s.Authorizer.Authorize(subject(ctx), topic, action)
+}
+
+var errTopicsUnimplemented = status.Error(codes.Unimplemented, "topics aren't supported")
+
+// topicObject returns the object a request for topic is authorized on.
+// The default log, with no topic, is the wildcard object.
+func topicObject(topic string) string {
+	if topic == "" {
+		return objectWildcard
+	}
+	return topic
+}
+
 func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (*api.GetServersResponse, error) {
 	servers, err := s.GetServerer.GetServers()
 	if err != nil {
@@ -171,7 +668,7 @@ type GetServerer interface {
 	GetServers() ([]*api.Server, error)
 }
 
-func authenticate(ctx context.Context) (context.Context, error) {
+func (s *grpcServer) authenticate(ctx context.Context) (context.Context, error) {
 	peer, ok := peer.FromContext(ctx)
 	if !ok {
 		return ctx, status.New(
@@ -180,12 +677,33 @@ func authenticate(ctx context.Context) (context.Context, error) {
 		).Err()
 	}
 
+	// A request that was forwarded once is never forwarded again, whatever
+	// credentials the peer has.
+	md, _ := metadata.FromIncomingContext(ctx)
+	fwd := md.Get(forwardedSubjectKey)
+	if len(fwd) > 0 {
+		ctx = context.WithValue(ctx, forwardedContextKey{}, true)
+	}
+
 	if peer.AuthInfo == nil {
 		return context.WithValue(ctx, subjectContextKey{}, ""), nil
 	}
 
 	tlsInfo := peer.AuthInfo.(credentials.TLSInfo)
 	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+
+	// A forwarded request acts as the original caller, as long as the peer
+	// that forwarded it is allowed to.
+	if len(fwd) > 0 {
+		if err := s.Authorizer.Authorize(
+			subject,
+			objectWildcard,
+			forwardAction,
+		); err != nil {
+			return ctx, err
+		}
+		subject = fwd[0]
+	}
 	ctx = context.WithValue(ctx, subjectContextKey{}, subject)
 
 	return ctx, nil
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"os"
 	"testing"
@@ -11,10 +12,12 @@ import (
 	"github.com/chmikata/proglog/internal/auth"
 	"github.com/chmikata/proglog/internal/config"
 	"github.com/chmikata/proglog/internal/log"
+	"github.com/hashicorp/raft"
 	"github.com/stretchr/testify/require"
 	"go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
@@ -33,6 +36,19 @@ func TestServer(t *testing.T) {
 		"produce/consume stream succeeds":            testProduceConsumeStream,
 		"consume past long boundary fails":           testConsumePastBoundary,
 		"unauthorized fails":                         testUnauthorized,
+		"get offset for time succeeds":               testGetOffsetForTime,
+		"produce batch succeeds":                     testProduceBatch,
+		"consume stream wakes on produce":            testConsumeStreamTail,
+		"consume batch succeeds":                     testConsumeBatch,
+		"get log info succeeds":                      testGetLogInfo,
+		"consume honours read consistency":           testConsumeConsistency,
+		"produce to a follower fails with leader":    testNotLeader,
+		"failures map to grpc codes":                 testErrorCodes,
+		"consumer group offsets succeed":             testConsumerGroups,
+		"idempotent produce deduplicates":            testIdempotentProduce,
+		"produce/consume a topic succeeds":           testTopics,
+		"produce/consume a partition succeeds":       testPartitions,
+		"snapshot on demand succeeds":                testSnapshot,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient, nobodyClient, cfg, teardown := setupTest(t, nil)
@@ -207,9 +223,11 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, cfg *Config
 	for i, record := range records {
 		res, err := cstream.Recv()
 		require.NoError(t, err)
+		require.NotZero(t, res.Record.Timestamp)
 		require.Equal(t, res.Record, &api.Record{
-			Value:  record.Value,
-			Offset: uint64(i),
+			Value:     record.Value,
+			Offset:    uint64(i),
+			Timestamp: res.Record.Timestamp,
 		})
 	}
 	cstream.SendMsg("done")
@@ -241,3 +259,737 @@ func testUnauthorized(t *testing.T, _, client api.LogClient, cfg *Config) {
 		t.Fatalf("got code :%d, want: %d", gotCode, wantCode)
 	}
 }
+
+func testGetOffsetForTime(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("before")},
+	})
+	require.NoError(t, err)
+	since := time.Now()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("after")},
+	})
+	require.NoError(t, err)
+
+	res, err := client.GetOffsetForTime(ctx, &api.GetOffsetForTimeRequest{
+		Timestamp: since.UnixNano(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset, res.Offset)
+
+	res, err = client.GetOffsetForTime(ctx, &api.GetOffsetForTimeRequest{
+		Timestamp: time.Now().Add(time.Hour).UnixNano(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset+1, res.Offset)
+}
+
+func testProduceBatch(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+	}
+	produce, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: records,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.FirstOffset)
+	require.Equal(t, uint64(1), produce.LastOffset)
+
+	for i, record := range records {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{
+			Offset: produce.FirstOffset + uint64(i),
+		})
+		require.NoError(t, err)
+		require.Equal(t, record.Value, consume.Record.Value)
+	}
+}
+
+func testConsumeStreamTail(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cstream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	res, err := cstream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func testConsumeBatch(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+		{Value: []byte("third message")},
+	}
+	_, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: records,
+	})
+	require.NoError(t, err)
+
+	consume, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{
+		Offset:     1,
+		MaxRecords: 5,
+	})
+	require.NoError(t, err)
+	require.Len(t, consume.Records, 2)
+	for i, record := range consume.Records {
+		require.Equal(t, uint64(i+1), record.Offset)
+		require.Equal(t, records[i+1].Value, record.Value)
+	}
+
+	cstream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:     0,
+		MaxRecords: 2,
+	})
+	require.NoError(t, err)
+	var got []*api.Record
+	for len(got) < len(records) {
+		res, err := cstream.Recv()
+		require.NoError(t, err)
+		require.Nil(t, res.Record)
+		require.LessOrEqual(t, len(res.Records), 2)
+		got = append(got, res.Records...)
+	}
+	for i, record := range got {
+		require.Equal(t, uint64(i), record.Offset)
+		require.Equal(t, records[i].Value, record.Value)
+	}
+}
+
+func testGetLogInfo(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	res, err := client.GetLogInfo(ctx, &api.GetLogInfoRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Info.LowestOffset)
+	require.Equal(t, uint64(1), res.Info.HighestOffset)
+	require.Equal(t, uint64(2), res.Info.NextOffset)
+	require.Equal(t, uint32(1), res.Info.SegmentCount)
+	require.Len(t, res.Info.Segments, 1)
+	require.NotZero(t, res.Info.TotalBytes)
+}
+
+func testConsumeConsistency(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset:      produce.Offset,
+		Consistency: api.ReadConsistency_READ_LINEARIZABLE,
+	})
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset, consume.Record.Offset)
+
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = client.Consume(waitCtx, &api.ConsumeRequest{
+		Offset:      produce.Offset,
+		Consistency: api.ReadConsistency_READ_AT_LEAST_OFFSET,
+		MinOffset:   produce.Offset + 1,
+	})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello again")},
+		})
+	}()
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:      produce.Offset + 1,
+		Consistency: api.ReadConsistency_READ_AT_LEAST_OFFSET,
+		MinOffset:   produce.Offset + 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello again"), consume.Record.Value)
+}
+
+// failingLog fails every append and read with err.
+type failingLog struct {
+	CommitLog
+	err error
+}
+
+func (l failingLog) Append(*api.Record) (uint64, error) {
+	return 0, l.err
+}
+
+func (l failingLog) Read(uint64) (*api.Record, error) {
+	return nil, l.err
+}
+
+type followerLeader struct{}
+
+func (followerLeader) Leader() (string, string, bool) {
+	return "leader", "127.0.0.1:8400", false
+}
+
+func testNotLeader(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	cfg.CommitLog = failingLog{CommitLog: cfg.CommitLog, err: raft.ErrNotLeader}
+	cfg.Leader = followerLeader{}
+	cfg.DisableForwarding = true
+
+	_, err := client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	hint, ok := api.NotLeader(err)
+	require.True(t, ok)
+	require.Equal(t, api.ErrNotLeader{
+		LeaderID:   "leader",
+		LeaderAddr: "127.0.0.1:8400",
+	}, hint)
+}
+
+func testErrorCodes(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+	clog := cfg.CommitLog
+
+	_, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	tests := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{
+			name: "offset out of range",
+			err:  api.ErrOffsetOutOfRange{Offset: 1},
+			code: codes.OutOfRange,
+		},
+		{
+			name: "offset compacted",
+			err:  api.ErrOffsetCompacted{Offset: 1},
+			code: codes.NotFound,
+		},
+		{
+			name: "corrupt record",
+			err:  api.ErrCorruptRecord{Path: "0.store", Pos: 8},
+			code: codes.DataLoss,
+		},
+		{
+			name: "record too large",
+			err:  api.ErrRecordTooLarge{Size: 1 << 31, Max: 1<<31 - 1},
+			code: codes.ResourceExhausted,
+		},
+		{
+			name: "leadership lost",
+			err:  raft.ErrLeadershipLost,
+			code: codes.Unavailable,
+		},
+		{
+			name: "raft shutdown",
+			err:  raft.ErrRaftShutdown,
+			code: codes.Unavailable,
+		},
+		{
+			name: "raft timeout",
+			err:  raft.ErrEnqueueTimeout,
+			code: codes.DeadlineExceeded,
+		},
+		{
+			name: "store I/O error",
+			err:  &os.PathError{Op: "read", Path: "0.store", Err: os.ErrClosed},
+			code: codes.Internal,
+		},
+	}
+	for _, tt := range tests {
+		cfg.CommitLog = failingLog{CommitLog: clog, err: tt.err}
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.Equal(t, tt.code, status.Code(err), tt.name)
+		_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+		require.Equal(t, tt.code, status.Code(err), tt.name)
+	}
+
+	for _, tt := range []struct {
+		err  api.ErrOffsetOutOfRange
+		desc string
+	}{
+		{err: api.ErrOffsetOutOfRange{Offset: 1, Removed: true}, desc: "removed by retention"},
+		{err: api.ErrOffsetOutOfRange{Offset: 9}, desc: "not written yet"},
+	} {
+		st := status.Convert(tt.err)
+		require.Len(t, st.Details(), 2)
+		info, ok := st.Details()[1].(*errdetails.ResourceInfo)
+		require.True(t, ok)
+		require.Equal(t, tt.desc, info.Description)
+	}
+
+	st := status.Convert(api.ErrLeadershipChanged{Cause: "leadership lost"})
+	require.Len(t, st.Details(), 3)
+	_, ok := st.Details()[2].(*errdetails.RetryInfo)
+	require.True(t, ok)
+}
+
+type groupOffsets map[string]uint64
+
+func (g groupOffsets) CommitOffset(group string, off uint64) error {
+	g[group] = off
+	return nil
+}
+
+func (g groupOffsets) FetchOffset(group string) (uint64, error) {
+	off, ok := g[group]
+	if !ok {
+		return 0, api.ErrNoCommittedOffset{Group: group}
+	}
+	return off, nil
+}
+
+func testConsumerGroups(t *testing.T, client, nobody api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	_, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "orders"})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	cfg.OffsetCommitter = groupOffsets{}
+	_, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	for _, v := range []string{"first", "second", "third"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(v)},
+		})
+		require.NoError(t, err)
+	}
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:  "orders",
+		Offset: 2,
+	})
+	require.NoError(t, err)
+	fetch, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), fetch.Offset)
+
+	_, err = nobody.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:  "orders",
+		Offset: 0,
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Group: "orders"})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("third"), res.Record.Value)
+}
+
+// sequencedLog deduplicates by the last sequence number of each producer.
+type sequencedLog struct {
+	CommitLog
+	last map[uint64][2]uint64
+}
+
+func (l *sequencedLog) RegisterProducer() (uint64, error) {
+	id := uint64(len(l.last) + 1)
+	l.last[id] = [2]uint64{}
+	return id, nil
+}
+
+func (l *sequencedLog) AppendRequest(req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	last, ok := l.last[req.ProducerId]
+	if !ok {
+		return nil, api.ErrUnknownProducer{ProducerID: req.ProducerId}
+	}
+	if req.Sequence == last[0] {
+		return &api.ProduceResponse{Offset: last[1]}, nil
+	}
+	off, err := l.Append(req.Record)
+	if err != nil {
+		return nil, err
+	}
+	l.last[req.ProducerId] = [2]uint64{req.Sequence, off}
+	return &api.ProduceResponse{Offset: off}, nil
+}
+
+func (l *sequencedLog) AppendBatchRequest(*api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "topics aren't supported")
+}
+
+func testIdempotentProduce(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	_, err := client.RegisterProducer(ctx, &api.RegisterProducerRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	cfg.Appender = &sequencedLog{
+		CommitLog: cfg.CommitLog,
+		last:      map[uint64][2]uint64{},
+	}
+	producer, err := client.RegisterProducer(ctx, &api.RegisterProducerRequest{})
+	require.NoError(t, err)
+
+	req := &api.ProduceRequest{
+		Record:     &api.Record{Value: []byte("hello world")},
+		ProducerId: producer.ProducerId,
+		Sequence:   1,
+	}
+	first, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	resent, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, first.Offset, resent.Offset)
+
+	req.Sequence = 0
+	_, err = client.Produce(ctx, req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	req.ProducerId = producer.ProducerId + 1
+	req.Sequence = 1
+	_, err = client.Produce(ctx, req)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: first.Offset + 1})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	expected := int64(0)
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:            &api.Record{Value: []byte("no key")},
+		ExpectedKeyOffset: &expected,
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// localTopics manages topics on a single node.
+type localTopics struct {
+	*log.Topics
+}
+
+func (t localTopics) CreateTopic(name string, config *api.TopicConfig) error {
+	return t.Create(name, config)
+}
+
+func (t localTopics) DeleteTopic(name string) error {
+	return t.Delete(name)
+}
+
+func (t localTopics) ListTopics() ([]*api.Topic, error) {
+	return t.List(), nil
+}
+
+func (t localTopics) ReadTopic(topic string, partition uint32, off uint64) (*api.Record, error) {
+	l, err := t.Get(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return l.Read(off)
+}
+
+func (t localTopics) ReadTopicBatch(topic string, partition uint32, off uint64, maxRecords int, maxBytes uint64) ([]*api.Record, error) {
+	l, err := t.Get(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return l.ReadBatch(off, maxRecords, maxBytes)
+}
+
+func (t localTopics) TopicOffsetForTime(topic string, partition uint32, tm time.Time) (uint64, error) {
+	l, err := t.Get(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	return l.OffsetForTime(tm)
+}
+
+func (t localTopics) TopicInfo(topic string, partition uint32) (*api.LogInfo, error) {
+	l, err := t.Get(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return l.Info()
+}
+
+func (t localTopics) WaitForTopicOffset(ctx context.Context, topic string, partition uint32, off uint64) error {
+	l, err := t.Get(topic, partition)
+	if err != nil {
+		return err
+	}
+	return l.WaitForOffset(ctx, off)
+}
+
+func (t localTopics) RegisterProducer() (uint64, error) {
+	return 0, status.Error(codes.Unimplemented, "producers aren't supported")
+}
+
+func (t localTopics) AppendRequest(req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	l, err := t.Get(req.Topic, req.GetPartition())
+	if err != nil {
+		return nil, err
+	}
+	off, err := l.Append(req.Record)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ProduceResponse{Offset: off, Partition: req.GetPartition()}, nil
+}
+
+func (t localTopics) AppendBatchRequest(req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	l, err := t.Get(req.Topic, req.GetPartition())
+	if err != nil {
+		return nil, err
+	}
+	first, err := l.AppendBatch(req.Records)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ProduceBatchResponse{
+		FirstOffset: first,
+		LastOffset:  first + uint64(len(req.Records)) - 1,
+		Partition:   req.GetPartition(),
+	}, nil
+}
+
+func testTopics(t *testing.T, client, nobody api.LogClient, cfg *Config) {
+	ctx := context.Background()
+	orders := &api.Topic{Name: "orders"}
+
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: orders})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	dir, err := os.MkdirTemp("", "server-test-topics")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := log.NewTopics(dir, log.Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	cfg.Topics = localTopics{topics}
+	cfg.Appender = localTopics{topics}
+
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: orders})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		topic *api.Topic
+		code  codes.Code
+	}{
+		{
+			name:  "ng case exists",
+			topic: orders,
+			code:  codes.AlreadyExists,
+		},
+		{
+			name:  "ng case empty",
+			topic: &api.Topic{},
+			code:  codes.InvalidArgument,
+		},
+		{
+			name:  "ng case invalid name",
+			topic: &api.Topic{Name: "orders/2024"},
+			code:  codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: tt.topic})
+		require.Equal(t, tt.code, status.Code(err), tt.name)
+	}
+	_, err = nobody.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic: &api.Topic{Name: "billing"},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("ordered")},
+		Topic:  "orders",
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+	_, err = nobody.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("ordered")},
+		Topic:  "orders",
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("ordered"), consume.Record.Value)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("ordered"), res.Record.Value)
+
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{
+			{Value: []byte("shipped")},
+			{Value: []byte("delivered")},
+		},
+		Topic: "orders",
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), batch.FirstOffset)
+	require.Equal(t, uint64(2), batch.LastOffset)
+	_, err = nobody.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{{Value: []byte("shipped")}},
+		Topic:   "orders",
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	consumeBatch, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{
+		Offset: 1,
+		Topic:  "orders",
+	})
+	require.NoError(t, err)
+	require.Len(t, consumeBatch.Records, 2)
+	require.Equal(t, []byte("delivered"), consumeBatch.Records[1].Value)
+	_, err = nobody.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Topic: "orders"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	batchStream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:     1,
+		Topic:      "orders",
+		MaxRecords: 2,
+	})
+	require.NoError(t, err)
+	res, err = batchStream.Recv()
+	require.NoError(t, err)
+	require.Len(t, res.Records, 2)
+	require.Equal(t, []byte("shipped"), res.Records[0].Value)
+
+	info, err := client.GetLogInfo(ctx, &api.GetLogInfoRequest{Topic: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), info.Info.HighestOffset)
+	offset, err := client.GetOffsetForTime(ctx, &api.GetOffsetForTimeRequest{
+		Topic: "orders",
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset.Offset)
+
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Topics, 1)
+	require.Equal(t, "orders", list.Topics[0].Name)
+
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Name: "orders"})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testPartitions(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	dir, err := os.MkdirTemp("", "server-test-partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := log.NewTopics(dir, log.Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	cfg.Topics = localTopics{topics}
+	cfg.Appender = localTopics{topics}
+
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic: &api.Topic{
+			Name:   "orders",
+			Config: &api.TopicConfig{Partitions: 2},
+		},
+	})
+	require.NoError(t, err)
+
+	partition := uint32(1)
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record:    &api.Record{Value: []byte("ordered")},
+		Topic:     "orders",
+		Partition: &partition,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), produce.Partition)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	tests := []struct {
+		name string
+		req  *api.ConsumeRequest
+		code codes.Code
+	}{
+		{
+			name: "ok case",
+			req:  &api.ConsumeRequest{Topic: "orders", Partition: 1},
+			code: codes.OK,
+		},
+		{
+			name: "ng case other partition",
+			req:  &api.ConsumeRequest{Topic: "orders", Partition: 0},
+			code: codes.OutOfRange,
+		},
+		{
+			name: "ng case past partitions",
+			req:  &api.ConsumeRequest{Topic: "orders", Partition: 2},
+			code: codes.NotFound,
+		},
+		{
+			name: "ng case default log",
+			req:  &api.ConsumeRequest{Partition: 1},
+			code: codes.NotFound,
+		},
+	}
+	for _, tt := range tests {
+		_, err := client.Consume(ctx, tt.req)
+		require.Equal(t, tt.code, status.Code(err), tt.name)
+	}
+}
+
+// snapshotter pretends to take a snapshot each time it is asked.
+type snapshotter struct {
+	taken []*api.SnapshotInfo
+}
+
+func (s *snapshotter) Snapshot() (*api.SnapshotInfo, error) {
+	info := &api.SnapshotInfo{
+		Id:        fmt.Sprint(len(s.taken)),
+		TakenAt:   time.Now().UnixNano(),
+		SizeBytes: 64,
+	}
+	s.taken = append(s.taken, info)
+	return info, nil
+}
+
+func testSnapshot(t *testing.T, client, nobody api.LogClient, cfg *Config) {
+	ctx := context.Background()
+
+	_, err := client.Snapshot(ctx, &api.SnapshotRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	snapshots := &snapshotter{}
+	cfg.Snapshotter = snapshots
+	res, err := client.Snapshot(ctx, &api.SnapshotRequest{})
+	require.NoError(t, err)
+	require.Len(t, snapshots.taken, 1)
+	require.Equal(t, snapshots.taken[0].Id, res.Snapshot.Id)
+	require.Equal(t, snapshots.taken[0].TakenAt, res.Snapshot.TakenAt)
+	require.Equal(t, uint64(64), res.Snapshot.SizeBytes)
+
+	_, err = nobody.Snapshot(ctx, &api.SnapshotRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Len(t, snapshots.taken, 1)
+}